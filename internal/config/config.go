@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,18 +14,49 @@ type APIConfig struct {
 	BaseURL        string `json:"base_url"`
 	Model          string `json:"model"`
 	EmbeddingModel string `json:"embedding_model"`
+	ContextSize    int    `json:"context_size"`
+	ReservedTokens int    `json:"reserved_tokens"`
 }
 
 type ChunkConfig struct {
-	Size    int `json:"size"`
-	Overlap int `json:"overlap"`
+	Size          int `json:"size"`
+	Overlap       int `json:"overlap"`
+	ParentSize    int `json:"parent_size"`
+	ParentOverlap int `json:"parent_overlap"`
 }
 
 type RetrievalConfig struct {
-	TopK          int     `json:"top_k"`
-	Threshold     float32 `json:"threshold"`
-	MMRLambda     float32 `json:"mmr_lambda"`
-	RecencyWeight float32 `json:"recency_weight"`
+	TopK          int           `json:"top_k"`
+	Threshold     float32       `json:"threshold"`
+	MMRLambda     float32       `json:"mmr_lambda"`
+	RecencyWeight float32       `json:"recency_weight"`
+	Recency       RecencyConfig `json:"recency"`
+	Neighbors     int           `json:"neighbors"`
+
+	CollapseDuplicates bool `json:"collapse_duplicates"`
+}
+
+type RecencyConfig struct {
+	Decay string `json:"decay"`
+	// HalfLife left zero uses the store default of 30 days.
+	HalfLife Duration `json:"half_life"`
+	Window   Duration `json:"window"`
+	DateKey  string   `json:"date_key"`
+}
+
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
 }
 
 type PostgresConfig struct {
@@ -34,32 +66,125 @@ type PostgresConfig struct {
 	Password string `json:"password"`
 	DBName   string `json:"dbname"`
 	SSLMode  string `json:"sslmode"`
+
+	Index PostgresIndexConfig `json:"index"`
+}
+
+type PostgresIndexConfig struct {
+	Type           string `json:"type"`
+	M              int    `json:"m"`
+	EFConstruction int    `json:"ef_construction"`
+	Lists          int    `json:"lists"`
+	EFSearch       int    `json:"ef_search"`
+	Probes         int    `json:"probes"`
+}
+
+type PromptTemplateConfig struct {
+	System    string `json:"system"`
+	Answer    string `json:"answer"`
+	NoResults string `json:"no_results"`
+}
+
+type PromptConfig struct {
+	Language  string                          `json:"language"`
+	Templates map[string]PromptTemplateConfig `json:"templates"`
+}
+
+func (p PromptConfig) Selected() PromptTemplateConfig {
+	if t, ok := p.Templates[p.Language]; ok {
+		return t
+	}
+	return p.Templates[defaultLanguage]
+}
+
+type BinaryConfig struct {
+	VectorType string `json:"vector_type"`
+}
+
+type VersionsConfig struct {
+	Keep   int      `json:"keep"`
+	MaxAge Duration `json:"max_age"`
+}
+
+type ExpiryConfig struct {
+	TTL Duration `json:"ttl"`
+}
+
+type DedupConfig struct {
+	Method             string  `json:"method"`
+	Threshold          float64 `json:"threshold"`
+	EmbeddingThreshold float32 `json:"embedding_threshold"`
+	Action             string  `json:"action"`
+	Weight             float32 `json:"weight"`
+}
+
+type RedactionConfig struct {
+	Enabled    bool               `json:"enabled"`
+	Types      []string           `json:"types"`
+	Patterns   []RedactionPattern `json:"patterns"`
+	MappingKey string             `json:"mapping_key"`
+	// Key is read from the environment only.
+	Key string `json:"-"`
+}
+
+type RedactionPattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+type QuantizationConfig struct {
+	Mode    string `json:"mode"`
+	Rescore int    `json:"rescore"`
 }
 
 type Config struct {
-	API       APIConfig       `json:"api"`
-	Chunk     ChunkConfig     `json:"chunk"`
-	Retrieval RetrievalConfig `json:"retrieval"`
-	Postgres  PostgresConfig  `json:"postgres"`
-	StoreType string          `json:"store_type"`
+	API          APIConfig          `json:"api"`
+	Chunk        ChunkConfig        `json:"chunk"`
+	Retrieval    RetrievalConfig    `json:"retrieval"`
+	Postgres     PostgresConfig     `json:"postgres"`
+	Binary       BinaryConfig       `json:"binary"`
+	Quantization QuantizationConfig `json:"quantization"`
+	Versions     VersionsConfig     `json:"versions"`
+	Expiry       ExpiryConfig       `json:"expiry"`
+	Dedup        DedupConfig        `json:"dedup"`
+	Redaction    RedactionConfig    `json:"redaction"`
+	Prompt       PromptConfig       `json:"prompt"`
+	StoreType    string             `json:"store_type"`
+	Collection   string             `json:"collection"`
 }
 
 const (
-	defaultChunkSize     = 500
-	defaultChunkOverlap  = 50
-	defaultTopK          = 5
-	defaultThreshold     = 0.1
-	defaultMMRLambda     = 0.5
-	defaultRecencyWeight = 0.2
-	defaultPostgresPort  = 5432
-	defaultStoreType     = "json"
-	defaultSSLMode       = "disable"
+	defaultContextSize    = 8192
+	defaultReservedTokens = 1024
+	defaultChunkSize      = 500
+	defaultChunkOverlap   = 50
+	defaultTopK           = 5
+	defaultThreshold      = 0.1
+	defaultMMRLambda      = 0.5
+	defaultRecencyWeight  = 0.2
+	defaultDecay          = "exponential"
+	defaultPostgresPort   = 5432
+	defaultStoreType      = "json"
+	defaultSSLMode        = "disable"
+	defaultIndexType      = "hnsw"
+	defaultHNSWM          = 16
+	defaultEFConstruction = 64
+	defaultIVFFlatLists   = 100
+	defaultEFSearch       = 40
+	defaultProbes         = 10
+	defaultVectorType     = "float32"
+	defaultLanguage       = "ja"
+	defaultCollection     = "default"
 )
 
 func LoadConfig(path string) (*Config, error) {
 	_ = godotenv.Load()
 
 	cfg := &Config{
+		API: APIConfig{
+			ContextSize:    defaultContextSize,
+			ReservedTokens: defaultReservedTokens,
+		},
 		Chunk: ChunkConfig{
 			Size:    defaultChunkSize,
 			Overlap: defaultChunkOverlap,
@@ -69,11 +194,29 @@ func LoadConfig(path string) (*Config, error) {
 			Threshold:     defaultThreshold,
 			MMRLambda:     defaultMMRLambda,
 			RecencyWeight: defaultRecencyWeight,
+			Recency: RecencyConfig{
+				Decay: defaultDecay,
+			},
+		},
+		StoreType:  defaultStoreType,
+		Collection: defaultCollection,
+		Prompt: PromptConfig{
+			Language: defaultLanguage,
 		},
-		StoreType: defaultStoreType,
 		Postgres: PostgresConfig{
 			Port:    defaultPostgresPort,
 			SSLMode: defaultSSLMode,
+			Index: PostgresIndexConfig{
+				Type:           defaultIndexType,
+				M:              defaultHNSWM,
+				EFConstruction: defaultEFConstruction,
+				Lists:          defaultIVFFlatLists,
+				EFSearch:       defaultEFSearch,
+				Probes:         defaultProbes,
+			},
+		},
+		Binary: BinaryConfig{
+			VectorType: defaultVectorType,
 		},
 	}
 
@@ -101,6 +244,15 @@ func LoadConfig(path string) (*Config, error) {
 	if embModel := os.Getenv("OPENAI_EMBEDDING_MODEL"); embModel != "" {
 		cfg.API.EmbeddingModel = embModel
 	}
+	if v := os.Getenv("RAG_LANGUAGE"); v != "" {
+		cfg.Prompt.Language = v
+	}
+	if v := os.Getenv("RAG_COLLECTION"); v != "" {
+		cfg.Collection = v
+	}
+	if v := os.Getenv("RAG_REDACTION_KEY"); v != "" {
+		cfg.Redaction.Key = v
+	}
 	if v := os.Getenv("POSTGRES_HOST"); v != "" {
 		cfg.Postgres.Host = v
 	}
@@ -2,13 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/tik-choco-lab/rag/internal/config"
 	"github.com/tik-choco-lab/rag/pkg/content"
+	"github.com/tik-choco-lab/rag/pkg/ingest"
 	"github.com/tik-choco-lab/rag/pkg/llm"
+	"github.com/tik-choco-lab/rag/pkg/prompt"
+	"github.com/tik-choco-lab/rag/pkg/redact"
 	"github.com/tik-choco-lab/rag/pkg/store"
 )
 
@@ -16,6 +23,7 @@ const (
 	configPath     = "config.json"
 	samplePath     = "sample.txt"
 	dbPath         = "store.json"
+	binaryPath     = "store.bin"
 	tableName      = "documents"
 	displayLen     = 20
 	searchSliceLen = 50
@@ -32,6 +40,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	promptFiles := cfg.Prompt.Selected()
+	templates, err := prompt.Load(prompt.Files{
+		System:    promptFiles.System,
+		Answer:    promptFiles.Answer,
+		NoResults: promptFiles.NoResults,
+	})
+	if err != nil {
+		log.Fatalf("Failed to load prompt templates: %v", err)
+	}
+
 	client := llm.NewOpenAIClient(llm.Config{
 		APIKey:         cfg.API.APIKey,
 		BaseURL:        cfg.API.BaseURL,
@@ -39,25 +57,116 @@ func main() {
 		EmbeddingModel: cfg.API.EmbeddingModel,
 	})
 
+	retention := store.RetentionOptions{
+		KeepVersions: cfg.Versions.Keep,
+		MaxAge:       time.Duration(cfg.Versions.MaxAge),
+	}
+	jsonOpts := store.JSONOptions{
+		VectorType: store.VectorType(cfg.Binary.VectorType),
+		Quantization: store.Quantization{
+			Mode:    content.QuantizationMode(cfg.Quantization.Mode),
+			Rescore: cfg.Quantization.Rescore,
+		},
+		Retention: retention,
+	}
+
 	var dataStore store.Store
-	if cfg.StoreType == "postgres" {
+	switch cfg.StoreType {
+	case "postgres":
 		connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
 			cfg.Postgres.Host, cfg.Postgres.Port, cfg.Postgres.User, cfg.Postgres.Password, cfg.Postgres.DBName, cfg.Postgres.SSLMode)
 		var err error
-		dataStore, err = store.NewPostgresStore(connStr, tableName)
+		pgOpts := store.PostgresOptions{
+			Index: store.IndexOptions{
+				Type:           store.IndexType(cfg.Postgres.Index.Type),
+				M:              cfg.Postgres.Index.M,
+				EFConstruction: cfg.Postgres.Index.EFConstruction,
+				Lists:          cfg.Postgres.Index.Lists,
+				EFSearch:       cfg.Postgres.Index.EFSearch,
+				Probes:         cfg.Postgres.Index.Probes,
+			},
+			Retention: retention,
+		}
+		dataStore, err = store.NewPostgresStore(connStr, tableName, pgOpts)
 		if err != nil {
 			log.Fatalf("Failed to initialize postgres store: %v", err)
 		}
 		fmt.Println("Using Postgres Store")
-	} else {
-		dataStore = store.NewJSONStore(dbPath)
+	case "binary":
+		if _, err := os.Stat(binaryPath); os.IsNotExist(err) {
+			if _, err := os.Stat(dbPath); err == nil {
+				if err := store.ConvertJSONToBinary(dbPath, binaryPath, jsonOpts.VectorType); err != nil {
+					log.Fatalf("Failed to convert JSON store: %v", err)
+				}
+				fmt.Printf("Converted %s to %s\n", dbPath, binaryPath)
+			}
+		}
+		dataStore = store.NewBinaryStore(binaryPath, jsonOpts)
+		fmt.Println("Using Binary Store")
+	default:
+		dataStore = store.NewJSONStore(dbPath, jsonOpts)
 		fmt.Println("Using JSON Store")
 	}
 	ctx := context.Background()
 
-	rawText, err := content.ReadTextFile(samplePath)
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		reindexOpts := store.ReindexOptions{
+			EmbeddingModel: cfg.API.EmbeddingModel,
+			Progress: func(done, total int) {
+				fmt.Printf("\rReindexed %d/%d documents", done, total)
+			},
+		}
+		if err := store.Reindex(ctx, dataStore, cfg.Collection, reindexOpts, client.CreateEmbeddings); err != nil {
+			log.Fatalf("Reindex failed: %v", err)
+		}
+		fmt.Printf("\nCollection %s now uses %s\n", cfg.Collection, cfg.API.EmbeddingModel)
+		return
+	}
+
+	if len(os.Args) > 2 && os.Args[1] == "export" {
+		f, err := os.Create(os.Args[2])
+		if err != nil {
+			log.Fatalf("Failed to create export file: %v", err)
+		}
+		defer f.Close()
+
+		exportOpts := store.ExportOptions{Format: store.ExportColumnar}
+		if strings.HasSuffix(os.Args[2], ".jsonl") {
+			exportOpts.Format = store.ExportJSONL
+		}
+		n, err := store.Export(ctx, dataStore, cfg.Collection, f, exportOpts)
+		if err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		fmt.Printf("Exported the current version of %d documents from %s to %s (archived versions are not exported)\n", n, cfg.Collection, os.Args[2])
+		return
+	}
+
+	if len(os.Args) > 2 && os.Args[1] == "import" {
+		f, err := os.Open(os.Args[2])
+		if err != nil {
+			log.Fatalf("Failed to open export file: %v", err)
+		}
+		defer f.Close()
+
+		n, err := store.Import(ctx, dataStore, cfg.Collection, f)
+		if err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		fmt.Printf("Imported %d documents into %s\n", n, cfg.Collection)
+		return
+	}
+
+	collection := store.Collection{Name: cfg.Collection, EmbeddingModel: cfg.API.EmbeddingModel, TTL: time.Duration(cfg.Expiry.TTL)}
+	if err := dataStore.CreateCollection(ctx, collection); err != nil && !errors.Is(err, store.ErrCollectionExists) {
+		log.Fatalf("Failed to create collection: %v", err)
+	}
+	purged, err := dataStore.Purge(ctx, cfg.Collection)
 	if err != nil {
-		log.Fatalf("Failed to read file: %v", err)
+		log.Fatalf("Failed to purge expired documents: %v", err)
+	}
+	if purged > 0 {
+		fmt.Printf("Purged %d expired documents\n", purged)
 	}
 
 	metadata := map[string]string{
@@ -65,10 +174,78 @@ func main() {
 		"date":    "2024-02-04",
 	}
 
-	err = dataStore.AddDocument(ctx, samplePath, rawText, metadata, cfg.Chunk.Size, cfg.Chunk.Overlap, client.CreateEmbeddings)
+	addOpts := store.AddOptions{
+		EmbeddingModel: cfg.API.EmbeddingModel,
+		ChunkSize:      cfg.Chunk.Size,
+		Overlap:        cfg.Chunk.Overlap,
+		ParentSize:     cfg.Chunk.ParentSize,
+		ParentOverlap:  cfg.Chunk.ParentOverlap,
+		Dedup: store.DedupOptions{
+			Method:             store.DedupMethod(cfg.Dedup.Method),
+			Threshold:          cfg.Dedup.Threshold,
+			EmbeddingThreshold: cfg.Dedup.EmbeddingThreshold,
+			Action:             store.DedupAction(cfg.Dedup.Action),
+			Weight:             cfg.Dedup.Weight,
+		},
+	}
+
+	pipeline := ingest.New(ingest.Options{
+		Store:          dataStore,
+		Collection:     cfg.Collection,
+		Add:            addOpts,
+		EmbeddingsFunc: client.CreateEmbeddings,
+	})
+	if err := pipeline.InsertAfter(ingest.StageSplit, ingest.DetectLanguage("language")); err != nil {
+		log.Fatalf("Failed to build ingestion pipeline: %v", err)
+	}
+	if cfg.Redaction.Enabled {
+		redactOpts := redact.Options{}
+		for _, t := range cfg.Redaction.Types {
+			redactOpts.Kinds = append(redactOpts.Kinds, redact.Kind(t))
+		}
+		for _, p := range cfg.Redaction.Patterns {
+			redactOpts.Custom = append(redactOpts.Custom, redact.Pattern{Kind: redact.Kind(p.Name), Pattern: p.Pattern})
+		}
+		if cfg.Redaction.Key != "" {
+			if redactOpts.Key, err = base64.StdEncoding.DecodeString(cfg.Redaction.Key); err != nil {
+				log.Fatalf("Invalid RAG_REDACTION_KEY: %v", err)
+			}
+		}
+		redactor, err := redact.New(redactOpts)
+		if err != nil {
+			log.Fatalf("Failed to create redactor: %v", err)
+		}
+		if err := pipeline.InsertAfter(ingest.StageClean, ingest.Redact(redactor, cfg.Redaction.MappingKey)); err != nil {
+			log.Fatalf("Failed to build ingestion pipeline: %v", err)
+		}
+	}
+
+	ingested := &ingest.Document{ID: samplePath, Source: samplePath, Metadata: metadata}
+	report, err := pipeline.Run(ctx, ingested)
+	for _, stage := range report.Stages {
+		fmt.Printf("Ingest %s: %v\n", stage.Stage, stage.Duration)
+	}
 	if err != nil {
 		log.Fatalf("Failed to add document: %v", err)
 	}
+	added := ingested.Result
+	fmt.Printf("Chunks: %d added, %d kept, %d removed, %d near duplicates\n", added.Added, added.Kept, added.Removed, added.Duplicates)
+
+	versions, err := dataStore.ListVersions(ctx, cfg.Collection, samplePath)
+	if err != nil {
+		log.Fatalf("Failed to list versions: %v", err)
+	}
+	fmt.Printf("Document %s: version %d, %d versions retained\n", samplePath, versions[len(versions)-1].Version, len(versions))
+
+	docs, err := dataStore.ListDocuments(ctx, cfg.Collection, store.ListOptions{})
+	if err != nil {
+		log.Fatalf("Failed to list documents: %v", err)
+	}
+	chunkCount, err := dataStore.CountChunks(ctx, cfg.Collection, nil)
+	if err != nil {
+		log.Fatalf("Failed to count chunks: %v", err)
+	}
+	fmt.Printf("Collection %s: %d documents, %d chunks\n", cfg.Collection, len(docs), chunkCount)
 
 	query := "RAGのメリットは何ありますか？"
 	fmt.Printf("\n--- Query: %s ---\n", query)
@@ -79,16 +256,27 @@ func main() {
 	}
 
 	searchOpts := store.SearchOptions{
-		TopK:          cfg.Retrieval.TopK,
-		Threshold:     cfg.Retrieval.Threshold,
-		MMRLambda:     cfg.Retrieval.MMRLambda,
-		RecencyWeight: cfg.Retrieval.RecencyWeight,
+		EmbeddingModel: cfg.API.EmbeddingModel,
+		TopK:           cfg.Retrieval.TopK,
+		Threshold:      cfg.Retrieval.Threshold,
+		MMRLambda:      cfg.Retrieval.MMRLambda,
+		RecencyWeight:  cfg.Retrieval.RecencyWeight,
+		Recency: store.RecencyOptions{
+			Decay:    cfg.Retrieval.Recency.Decay,
+			HalfLife: time.Duration(cfg.Retrieval.Recency.HalfLife),
+			Window:   time.Duration(cfg.Retrieval.Recency.Window),
+			DateKey:  cfg.Retrieval.Recency.DateKey,
+		},
+		ReturnParents:      cfg.Chunk.ParentSize > 0,
+		Neighbors:          cfg.Retrieval.Neighbors,
+		Overlap:            cfg.Chunk.Overlap,
+		CollapseDuplicates: cfg.Retrieval.CollapseDuplicates,
 		Metadata: map[string]string{
 			"version": "v1.0",
 		},
 	}
 
-	results, err := dataStore.RecencySearch(ctx, queryEmbedding, searchOpts)
+	results, err := dataStore.RecencySearch(ctx, cfg.Collection, queryEmbedding, searchOpts)
 
 	if err != nil {
 		log.Fatalf("Search failed: %v", err)
@@ -104,23 +292,30 @@ func main() {
 		fmt.Printf("[Score: %.4f] %s...\n", res.Score, string(r[:l]))
 	}
 
-	answer, err := client.Chat(ctx, buildPrompt(results, query))
+	data := prompt.NewData(query, results, nil)
+	packer := prompt.NewPacker(cfg.API.ContextSize, cfg.API.ReservedTokens, cfg.Chunk.Overlap)
+	packer.Parents = searchOpts.ReturnParents
+	overhead, err := templates.Overhead(data, packer)
 	if err != nil {
-		log.Fatalf("Chat failed: %v", err)
+		log.Fatalf("Failed to build prompt: %v", err)
 	}
 
-	fmt.Printf("\nAnswer:\n%s\n", answer)
-}
+	packed := packer.Pack(results, overhead)
+	fmt.Printf("\n--- Context: %d tokens, %d included, %d dropped ---\n", packed.Tokens, len(packed.Included), len(packed.Dropped))
+	for _, ref := range packed.Included {
+		fmt.Printf("%s %v (%d tokens, trimmed=%t)\n", ref.DocID, ref.ChunkIndices, ref.Tokens, ref.Trimmed)
+	}
 
-func buildPrompt(results []content.SearchResult, query string) string {
-	if len(results) == 0 {
-		return fmt.Sprintf("資料が見つかりませんでした。以下の質問にあなたの知識で答えてください。\n\n# 質問\n%s", query)
+	data.Results = packed.Results
+	messages, err := templates.Build(data)
+	if err != nil {
+		log.Fatalf("Failed to build prompt: %v", err)
 	}
 
-	var contextText string
-	for _, res := range results {
-		contextText += res.Text + "\n---\n"
+	answer, err := client.ChatMessages(ctx, messages)
+	if err != nil {
+		log.Fatalf("Chat failed: %v", err)
 	}
 
-	return fmt.Sprintf("以下の資料を参考に、質問に答えてください。\n\n# 資料\n%s\n\n# 質問\n%s", contextText, query)
+	fmt.Printf("\nAnswer:\n%s\n", answer)
 }
@@ -6,7 +6,6 @@ import (
 	"math"
 	"os"
 	"regexp"
-	"slices"
 	"strings"
 )
 
@@ -72,6 +71,12 @@ func SplitText(text string, maxChunkSize int, overlap int) []string {
 	return chunks
 }
 
+// MergeOverlap appends b to a without the first overlap runes of b.
+func MergeOverlap(a, b string, overlap int) string {
+	rb := []rune(b)
+	return a + string(rb[min(max(overlap, 0), len(rb)):])
+}
+
 func CosineSimilarity(v1, v2 []float32) float32 {
 	if len(v1) != len(v2) || len(v1) == 0 {
 		return 0
@@ -89,97 +94,28 @@ func CosineSimilarity(v1, v2 []float32) float32 {
 }
 
 type SearchResult struct {
-	Text  string
+	DocID       string
+	ChunkIndex  int
+	ParentIndex int
+	Text        string
+	Score       float32
+	Metadata    map[string]string
+}
+
+type Ranked struct {
+	Index int
 	Score float32
 }
 
 func SearchTopK(queryEmbedding []float32, chunks []string, embeddings [][]float32, k int, threshold float32, mmrLambda float32) []SearchResult {
-	var candidates []int
-	for i, emb := range embeddings {
-		score := CosineSimilarity(queryEmbedding, emb)
-		if score >= threshold {
-			candidates = append(candidates, i)
-		}
-	}
-
-	if len(candidates) == 0 {
+	ranked := RankTopK(queryEmbedding, embeddings, k, threshold, mmrLambda)
+	if len(ranked) == 0 {
 		return nil
 	}
 
-	if mmrLambda >= 1.0 {
-		var results []SearchResult
-		for _, idx := range candidates {
-			score := CosineSimilarity(queryEmbedding, embeddings[idx])
-			results = append(results, SearchResult{Text: chunks[idx], Score: score})
-		}
-
-		slices.SortFunc(results, func(a, b SearchResult) int {
-			if a.Score > b.Score {
-				return -1
-			}
-			if a.Score < b.Score {
-				return 1
-			}
-			return 0
-		})
-
-		if len(results) > k {
-			return results[:k]
-		}
-		return results
-	}
-
-	selectedIndices := make([]int, 0, k)
-	for len(selectedIndices) < k && len(selectedIndices) < len(candidates) {
-		bestIdx := -1
-		var maxMMR float32 = minSimilarity
-
-		for _, candIdx := range candidates {
-			if contains(selectedIndices, candIdx) {
-				continue
-			}
-
-			simQuery := CosineSimilarity(queryEmbedding, embeddings[candIdx])
-			var maxSimSelected float32 = minSimilarity
-			if len(selectedIndices) == 0 {
-				maxSimSelected = 0
-			} else {
-				for _, selIdx := range selectedIndices {
-					simDoc := CosineSimilarity(embeddings[candIdx], embeddings[selIdx])
-					if simDoc > maxSimSelected {
-						maxSimSelected = simDoc
-					}
-				}
-			}
-
-			mmrScore := mmrLambda*simQuery - (1-mmrLambda)*maxSimSelected
-			if mmrScore > maxMMR {
-				maxMMR = mmrScore
-				bestIdx = candIdx
-			}
-		}
-
-		if bestIdx == -1 {
-			break
-		}
-		selectedIndices = append(selectedIndices, bestIdx)
-	}
-
-	var finalResults []SearchResult
-	for _, idx := range selectedIndices {
-		finalResults = append(finalResults, SearchResult{
-			Text:  chunks[idx],
-			Score: CosineSimilarity(queryEmbedding, embeddings[idx]),
-		})
-	}
-	return finalResults
-}
-
-func contains(slice []int, val int) bool {
-	for _, item := range slice {
-		if item == val {
-			return true
-		}
+	results := make([]SearchResult, len(ranked))
+	for i, r := range ranked {
+		results[i] = SearchResult{Text: chunks[r.Index], Score: r.Score}
 	}
-	return false
+	return results
 }
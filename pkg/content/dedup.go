@@ -0,0 +1,113 @@
+package content
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"unicode"
+)
+
+const (
+	simHashBits = 64
+	minHashSeed = 0x9e3779b97f4a7c15
+	minHashStep = 0xbf58476d1ce4e5b9
+)
+
+// Runs of characters rather than words keep it working for Japanese, which is
+// written without spaces.
+func Shingles(text string, size int) []uint64 {
+	var runes []rune
+	space := false
+	for _, r := range strings.TrimSpace(text) {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if space && len(runes) > 0 {
+			runes = append(runes, ' ')
+		}
+		space = false
+		runes = append(runes, unicode.ToLower(r))
+	}
+	if len(runes) == 0 {
+		return nil
+	}
+	size = max(min(size, len(runes)), 1)
+
+	seen := make(map[uint64]bool)
+	var shingles []uint64
+	for i := 0; i+size <= len(runes); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(string(runes[i : i+size])))
+		if sum := h.Sum64(); !seen[sum] {
+			seen[sum] = true
+			shingles = append(shingles, sum)
+		}
+	}
+	return shingles
+}
+
+// MinHash returns n minimum hashes of shingles. The share of positions at
+// which two signatures agree estimates the Jaccard similarity of the sets.
+func MinHash(shingles []uint64, n int) []uint64 {
+	sig := make([]uint64, n)
+	for i := range sig {
+		sig[i] = ^uint64(0)
+	}
+	for _, s := range shingles {
+		for i := range sig {
+			if h := mix64(s ^ (minHashSeed + uint64(i)*minHashStep)); h < sig[i] {
+				sig[i] = h
+			}
+		}
+	}
+	return sig
+}
+
+func MinHashSimilarity(a, b []uint64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a))
+}
+
+func SimHash(shingles []uint64) uint64 {
+	var weights [simHashBits]int
+	for _, s := range shingles {
+		h := mix64(s)
+		for i := range weights {
+			if h&(1<<i) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+	var sig uint64
+	for i, w := range weights {
+		if w > 0 {
+			sig |= 1 << i
+		}
+	}
+	return sig
+}
+
+func SimHashSimilarity(a, b uint64) float64 {
+	return 1 - float64(bits.OnesCount64(a^b))/simHashBits
+}
+
+// mix64 is the finaliser of SplitMix64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
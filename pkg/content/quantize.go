@@ -0,0 +1,171 @@
+package content
+
+import (
+	"math"
+	"math/bits"
+	"slices"
+)
+
+type QuantizationMode string
+
+const (
+	QuantizeNone   QuantizationMode = ""
+	QuantizeInt8   QuantizationMode = "int8"
+	QuantizeBinary QuantizationMode = "binary"
+
+	int8Levels           = 127
+	bitsPerWord          = 64
+	defaultRescoreFactor = 4
+	minRecallThreshold   = -2
+)
+
+type Quantized struct {
+	Int8  []int8
+	Scale float32
+	Bits  []uint64
+	Dim   int
+}
+
+type RecallReport struct {
+	Mode           QuantizationMode
+	K              int
+	Queries        int
+	RawRecall      float64
+	RescoredRecall float64
+}
+
+func Quantize(v []float32, mode QuantizationMode) Quantized {
+	q := Quantized{Dim: len(v)}
+	switch mode {
+	case QuantizeInt8:
+		var norm, maxAbs float64
+		for _, x := range v {
+			norm += float64(x) * float64(x)
+			maxAbs = math.Max(maxAbs, math.Abs(float64(x)))
+		}
+		if norm == 0 || maxAbs == 0 {
+			q.Int8 = make([]int8, len(v))
+			return q
+		}
+		norm = math.Sqrt(norm)
+		scale := maxAbs / norm / int8Levels
+		q.Scale = float32(scale)
+		q.Int8 = make([]int8, len(v))
+		for i, x := range v {
+			q.Int8[i] = int8(math.Round(float64(x) / norm / scale))
+		}
+	case QuantizeBinary:
+		q.Bits = make([]uint64, (len(v)+bitsPerWord-1)/bitsPerWord)
+		for i, x := range v {
+			if x > 0 {
+				q.Bits[i/bitsPerWord] |= 1 << (uint(i) % bitsPerWord)
+			}
+		}
+	}
+	return q
+}
+
+func HammingDistance(a, b []uint64) int {
+	if len(a) != len(b) {
+		return math.MaxInt
+	}
+	var d int
+	for i := range a {
+		d += bits.OnesCount64(a[i] ^ b[i])
+	}
+	return d
+}
+
+// ApproxSimilarity estimates cosine similarity from the codes of two vectors.
+func ApproxSimilarity(a, b Quantized, mode QuantizationMode) float32 {
+	switch mode {
+	case QuantizeInt8:
+		if len(a.Int8) != len(b.Int8) {
+			return minSimilarity
+		}
+		var dot int64
+		for i := range a.Int8 {
+			dot += int64(a.Int8[i]) * int64(b.Int8[i])
+		}
+		return float32(dot) * a.Scale * b.Scale
+	case QuantizeBinary:
+		if a.Dim != b.Dim || a.Dim == 0 {
+			return minSimilarity
+		}
+		return 1 - 2*float32(HammingDistance(a.Bits, b.Bits))/float32(a.Dim)
+	default:
+		return minSimilarity
+	}
+}
+
+// RankQuantized rescores the best k*rescore codes at full precision.
+// Embeddings must be unit length.
+func RankQuantized(queryEmbedding []float32, embeddings [][]float32, codes []Quantized, mode QuantizationMode, k, rescore int, threshold float32, mmrLambda float32) []Ranked {
+	query := Normalize(queryEmbedding)
+	candidates := prefilter(query, codes, mode, k*rescoreFactor(rescore))
+
+	var ranked []Ranked
+	for _, c := range candidates {
+		score := Dot(query, embeddings[c.Index])
+		if score >= threshold {
+			ranked = append(ranked, Ranked{Index: c.Index, Score: score})
+		}
+	}
+	if len(ranked) == 0 {
+		return nil
+	}
+	return SelectMMR(ranked, embeddings, k, mmrLambda)
+}
+
+func MeasureRecall(queries, embeddings [][]float32, mode QuantizationMode, k, rescore int) RecallReport {
+	report := RecallReport{Mode: mode, K: k, Queries: len(queries)}
+	if len(queries) == 0 || len(embeddings) == 0 {
+		return report
+	}
+
+	normalized := make([][]float32, len(embeddings))
+	codes := make([]Quantized, len(embeddings))
+	for i, emb := range embeddings {
+		normalized[i] = Normalize(emb)
+		codes[i] = Quantize(normalized[i], mode)
+	}
+
+	var raw, rescored float64
+	for _, q := range queries {
+		exact := RankNormalized(Normalize(q), normalized, k, minRecallThreshold, 1.0)
+		raw += overlap(exact, prefilter(q, codes, mode, k))
+		rescored += overlap(exact, RankQuantized(q, normalized, codes, mode, k, rescore, minRecallThreshold, 1.0))
+	}
+	report.RawRecall = raw / float64(len(queries))
+	report.RescoredRecall = rescored / float64(len(queries))
+	return report
+}
+
+func prefilter(queryEmbedding []float32, codes []Quantized, mode QuantizationMode, n int) []Ranked {
+	query := Quantize(queryEmbedding, mode)
+	top := newTopK(n)
+	for i, c := range codes {
+		top.offer(Ranked{Index: i, Score: ApproxSimilarity(query, c, mode)})
+	}
+	return top.sorted()
+}
+
+func overlap(exact, approx []Ranked) float64 {
+	if len(exact) == 0 {
+		return 1
+	}
+	var hits int
+	for _, e := range exact {
+		if slices.ContainsFunc(approx, func(a Ranked) bool { return a.Index == e.Index }) {
+			hits++
+		}
+	}
+	return float64(hits) / float64(len(exact))
+}
+
+func rescoreFactor(rescore int) int {
+	if rescore <= 0 {
+		return defaultRescoreFactor
+	}
+	return rescore
+}
@@ -0,0 +1,65 @@
+package content
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// recallFixture returns embeddings clustered around a few centroids, the way
+// chunks of related documents are, and queries drawn near the same centroids.
+func recallFixture(seed int64, n, queries, dim, clusters int) ([][]float32, [][]float32) {
+	rng := rand.New(rand.NewSource(seed))
+	centroids := make([][]float32, clusters)
+	for i := range centroids {
+		centroids[i] = make([]float32, dim)
+		for j := range centroids[i] {
+			centroids[i][j] = float32(rng.NormFloat64())
+		}
+	}
+	near := func(noise float64) []float32 {
+		c := centroids[rng.Intn(clusters)]
+		v := make([]float32, dim)
+		for j := range v {
+			v[j] = c[j] + float32(noise*rng.NormFloat64())
+		}
+		return v
+	}
+
+	embeddings := make([][]float32, n)
+	for i := range embeddings {
+		embeddings[i] = near(0.8)
+	}
+	qs := make([][]float32, queries)
+	for i := range qs {
+		qs[i] = near(1.0)
+	}
+	return embeddings, qs
+}
+
+func TestMeasureRecall(t *testing.T) {
+	embeddings, queries := recallFixture(1, 2000, 50, 256, 40)
+
+	tests := []struct {
+		mode        QuantizationMode
+		rescore     int
+		minRaw      float64
+		minRescored float64
+	}{
+		{QuantizeInt8, 4, 0.95, 0.99},
+		{QuantizeBinary, 4, 0.35, 0.93},
+		{QuantizeBinary, 10, 0.35, 0.99},
+	}
+	for _, tt := range tests {
+		report := MeasureRecall(queries, embeddings, tt.mode, 10, tt.rescore)
+		t.Logf("%s rescore=%d: raw %.3f, rescored %.3f", tt.mode, tt.rescore, report.RawRecall, report.RescoredRecall)
+		if report.RawRecall < tt.minRaw {
+			t.Errorf("%s rescore=%d: raw recall %.3f, want at least %.2f", tt.mode, tt.rescore, report.RawRecall, tt.minRaw)
+		}
+		if report.RescoredRecall < tt.minRescored {
+			t.Errorf("%s rescore=%d: rescored recall %.3f, want at least %.2f", tt.mode, tt.rescore, report.RescoredRecall, tt.minRescored)
+		}
+		if report.RescoredRecall < report.RawRecall {
+			t.Errorf("%s rescore=%d: rescoring lowered recall from %.3f to %.3f", tt.mode, tt.rescore, report.RawRecall, report.RescoredRecall)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package content
+
+import (
+	"container/heap"
+	"math"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+const parallelScoreThreshold = 8192
+
+func Normalize(v []float32) []float32 {
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	out := make([]float32, len(v))
+	if norm == 0 {
+		return out
+	}
+	inv := 1 / math.Sqrt(norm)
+	for i, x := range v {
+		out[i] = float32(float64(x) * inv)
+	}
+	return out
+}
+
+// Dot accumulates in float64 as CosineSimilarity does.
+func Dot(v1, v2 []float32) float32 {
+	if len(v1) != len(v2) {
+		return 0
+	}
+	var sum float64
+	for i := range v1 {
+		sum += float64(v1[i]) * float64(v2[i])
+	}
+	return float32(sum)
+}
+
+// RankTopK ranks embeddings of any length by cosine similarity.
+func RankTopK(queryEmbedding []float32, embeddings [][]float32, k int, threshold float32, mmrLambda float32) []Ranked {
+	if mmrLambda >= 1.0 {
+		top := newTopK(k)
+		for i, emb := range embeddings {
+			if score := CosineSimilarity(queryEmbedding, emb); score >= threshold {
+				top.offer(Ranked{Index: i, Score: score})
+			}
+		}
+		return top.sorted()
+	}
+
+	normalized := make([][]float32, len(embeddings))
+	for i, emb := range embeddings {
+		normalized[i] = Normalize(emb)
+	}
+	return RankNormalized(Normalize(queryEmbedding), normalized, k, threshold, mmrLambda)
+}
+
+// RankNormalized is RankTopK for unit-length embeddings.
+func RankNormalized(queryEmbedding []float32, embeddings [][]float32, k int, threshold float32, mmrLambda float32) []Ranked {
+	scores := scoreAll(queryEmbedding, embeddings)
+
+	if mmrLambda >= 1.0 {
+		top := newTopK(k)
+		for i, score := range scores {
+			if score >= threshold {
+				top.offer(Ranked{Index: i, Score: score})
+			}
+		}
+		return top.sorted()
+	}
+
+	var candidates []Ranked
+	for i, score := range scores {
+		if score >= threshold {
+			candidates = append(candidates, Ranked{Index: i, Score: score})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return SelectMMR(candidates, embeddings, k, mmrLambda)
+}
+
+// SelectMMR picks up to k candidates by MMR. Embeddings must be unit length.
+func SelectMMR(candidates []Ranked, embeddings [][]float32, k int, mmrLambda float32) []Ranked {
+	if mmrLambda >= 1.0 {
+		top := newTopK(k)
+		for _, c := range candidates {
+			top.offer(c)
+		}
+		return top.sorted()
+	}
+
+	maxSimSelected := make([]float32, len(candidates))
+	used := make([]bool, len(candidates))
+	selected := make([]Ranked, 0, min(k, len(candidates)))
+
+	for len(selected) < k && len(selected) < len(candidates) {
+		best := -1
+		var maxMMR float32 = minSimilarity
+
+		for i, cand := range candidates {
+			if used[i] {
+				continue
+			}
+			mmrScore := mmrLambda*cand.Score - (1-mmrLambda)*maxSimSelected[i]
+			if mmrScore > maxMMR {
+				maxMMR = mmrScore
+				best = i
+			}
+		}
+
+		if best == -1 {
+			break
+		}
+		used[best] = true
+		selected = append(selected, candidates[best])
+
+		chosen := embeddings[candidates[best].Index]
+		for i, cand := range candidates {
+			if used[i] {
+				continue
+			}
+			sim := Dot(embeddings[cand.Index], chosen)
+			if len(selected) == 1 || sim > maxSimSelected[i] {
+				maxSimSelected[i] = sim
+			}
+		}
+	}
+	return selected
+}
+
+func scoreAll(queryEmbedding []float32, embeddings [][]float32) []float32 {
+	scores := make([]float32, len(embeddings))
+	workers := runtime.GOMAXPROCS(0)
+	if len(embeddings) < parallelScoreThreshold || workers == 1 {
+		for i, emb := range embeddings {
+			scores[i] = Dot(queryEmbedding, emb)
+		}
+		return scores
+	}
+
+	var wg sync.WaitGroup
+	size := (len(embeddings) + workers - 1) / workers
+	for start := 0; start < len(embeddings); start += size {
+		end := min(start+size, len(embeddings))
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				scores[i] = Dot(queryEmbedding, embeddings[i])
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return scores
+}
+
+type topK struct {
+	k     int
+	items rankedHeap
+}
+
+func newTopK(k int) *topK {
+	return &topK{k: k}
+}
+
+func (t *topK) offer(r Ranked) {
+	if t.k <= 0 {
+		return
+	}
+	if len(t.items) < t.k {
+		heap.Push(&t.items, r)
+		return
+	}
+	if r.Score > t.items[0].Score {
+		t.items[0] = r
+		heap.Fix(&t.items, 0)
+	}
+}
+
+func (t *topK) sorted() []Ranked {
+	if len(t.items) == 0 {
+		return nil
+	}
+	results := slices.Clone([]Ranked(t.items))
+	slices.SortStableFunc(results, func(a, b Ranked) int {
+		if a.Score > b.Score {
+			return -1
+		}
+		if a.Score < b.Score {
+			return 1
+		}
+		return a.Index - b.Index
+	})
+	return results
+}
+
+type rankedHeap []Ranked
+
+func (h rankedHeap) Len() int { return len(h) }
+func (h rankedHeap) Less(i, j int) bool {
+	if h[i].Score != h[j].Score {
+		return h[i].Score < h[j].Score
+	}
+	return h[i].Index > h[j].Index
+}
+func (h rankedHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *rankedHeap) Push(x any) { *h = append(*h, x.(Ranked)) }
+
+func (h *rankedHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,85 @@
+package content
+
+import (
+	"slices"
+	"testing"
+)
+
+// sortTopK is the ranking SearchTopK did before the heap: cosine similarity
+// against every embedding, then a sort of all candidates.
+func sortTopK(queryEmbedding []float32, embeddings [][]float32, k int, threshold float32) []Ranked {
+	var candidates []Ranked
+	for i, emb := range embeddings {
+		if score := CosineSimilarity(queryEmbedding, emb); score >= threshold {
+			candidates = append(candidates, Ranked{Index: i, Score: score})
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b Ranked) int {
+		if a.Score > b.Score {
+			return -1
+		}
+		if a.Score < b.Score {
+			return 1
+		}
+		return a.Index - b.Index
+	})
+	return candidates[:min(k, len(candidates))]
+}
+
+func normalizeAll(embeddings [][]float32) [][]float32 {
+	normalized := make([][]float32, len(embeddings))
+	for i, emb := range embeddings {
+		normalized[i] = Normalize(emb)
+	}
+	return normalized
+}
+
+func TestRankNormalizedMatchesSort(t *testing.T) {
+	embeddings, queries := recallFixture(2, 3000, 20, 128, 30)
+	normalized := normalizeAll(embeddings)
+
+	for _, q := range queries {
+		want := sortTopK(q, embeddings, 10, 0)
+		got := RankNormalized(Normalize(q), normalized, 10, 0, 1.0)
+		if len(got) != len(want) {
+			t.Fatalf("got %d results, want %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].Index != want[i].Index {
+				t.Fatalf("result %d is %d (%.6f), want %d (%.6f)", i, got[i].Index, got[i].Score, want[i].Index, want[i].Score)
+			}
+		}
+	}
+}
+
+const (
+	benchmarkVectors = 20000
+	benchmarkDim     = 768
+	benchmarkK       = 10
+)
+
+func BenchmarkRankSortTopK(b *testing.B) {
+	embeddings, queries := recallFixture(3, benchmarkVectors, 1, benchmarkDim, 50)
+	b.ResetTimer()
+	for range b.N {
+		sortTopK(queries[0], embeddings, benchmarkK, 0)
+	}
+}
+
+func BenchmarkRankHeapTopK(b *testing.B) {
+	embeddings, queries := recallFixture(3, benchmarkVectors, 1, benchmarkDim, 50)
+	b.ResetTimer()
+	for range b.N {
+		RankTopK(queries[0], embeddings, benchmarkK, 0, 1.0)
+	}
+}
+
+func BenchmarkRankNormalized(b *testing.B) {
+	embeddings, queries := recallFixture(3, benchmarkVectors, 1, benchmarkDim, 50)
+	normalized := normalizeAll(embeddings)
+	query := Normalize(queries[0])
+	b.ResetTimer()
+	for range b.N {
+		RankNormalized(query, normalized, benchmarkK, 0, 1.0)
+	}
+}
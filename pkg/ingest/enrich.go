@@ -0,0 +1,36 @@
+package ingest
+
+import (
+	"context"
+	"unicode"
+)
+
+const (
+	StageLanguage = "language"
+
+	// japaneseShare is the share of letters in Japanese script above which a
+	// text counts as Japanese even when it mixes in English words.
+	japaneseShare = 0.2
+)
+
+func DetectLanguage(key string) Stage {
+	return NewStage(StageLanguage, func(ctx context.Context, doc *Document) error {
+		var japanese, latin int
+		for _, r := range doc.Text {
+			switch {
+			case unicode.In(r, unicode.Hiragana, unicode.Katakana, unicode.Han):
+				japanese++
+			case unicode.In(r, unicode.Latin):
+				latin++
+			}
+		}
+		switch {
+		case japanese+latin == 0:
+		case float64(japanese) >= japaneseShare*float64(japanese+latin):
+			doc.SetMetadata(key, "ja")
+		default:
+			doc.SetMetadata(key, "en")
+		}
+		return nil
+	})
+}
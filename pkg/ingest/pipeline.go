@@ -0,0 +1,176 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/tik-choco-lab/rag/pkg/store"
+)
+
+const (
+	StageLoad  = "load"
+	StageClean = "clean"
+	StageSplit = "split"
+	StageDedup = "dedup"
+	StageEmbed = "embed"
+	StageStore = "store"
+)
+
+var ErrUnknownStage = errors.New("unknown stage")
+
+type EmbeddingsFunc func(ctx context.Context, texts []string) ([][]float32, error)
+
+type Document struct {
+	ID       string
+	Source   string
+	Text     string
+	Hash     string
+	Metadata map[string]string
+	Chunks   []store.Chunk
+	Result   store.AddResult
+
+	// Splitting folds Redacted into Hash, so a change to a redacted value
+	// makes a new version.
+	Redacted map[string]string
+}
+
+// SetMetadata copies the metadata, which the caller may share with other
+// documents.
+func (d *Document) SetMetadata(key, value string) {
+	metadata := maps.Clone(d.Metadata)
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata[key] = value
+	d.Metadata = metadata
+}
+
+type Stage interface {
+	Name() string
+	Process(ctx context.Context, doc *Document) error
+}
+
+type stageFunc struct {
+	name string
+	fn   func(ctx context.Context, doc *Document) error
+}
+
+func (s stageFunc) Name() string { return s.name }
+
+func (s stageFunc) Process(ctx context.Context, doc *Document) error { return s.fn(ctx, doc) }
+
+func NewStage(name string, fn func(ctx context.Context, doc *Document) error) Stage {
+	return stageFunc{name: name, fn: fn}
+}
+
+type StageReport struct {
+	Stage    string
+	Duration time.Duration
+	Err      error
+}
+
+type Report struct {
+	Stages []StageReport
+}
+
+func (r Report) Total() time.Duration {
+	var total time.Duration
+	for _, s := range r.Stages {
+		total += s.Duration
+	}
+	return total
+}
+
+type Pipeline struct {
+	stages []Stage
+}
+
+type Options struct {
+	Store          store.Store
+	Collection     string
+	Add            store.AddOptions
+	EmbeddingsFunc EmbeddingsFunc
+}
+
+// New returns the standard pipeline, which stores a document the way
+// store.Store.AddDocument does.
+func New(options Options) *Pipeline {
+	return NewPipeline(
+		Load(),
+		Clean(),
+		Split(options.Add),
+		Dedup(options.Store, options.Collection, options.Add.Dedup),
+		Embed(options.Store, options.Collection, options.EmbeddingsFunc),
+		Store(options.Store, options.Collection, options.Add, options.EmbeddingsFunc),
+	)
+}
+
+func NewPipeline(stages ...Stage) *Pipeline {
+	return &Pipeline{stages: stages}
+}
+
+func (p *Pipeline) Stages() []string {
+	names := make([]string, len(p.stages))
+	for i, s := range p.stages {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+func (p *Pipeline) InsertBefore(name string, stage Stage) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages = slices.Insert(p.stages, i, stage)
+	return nil
+}
+
+func (p *Pipeline) InsertAfter(name string, stage Stage) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages = slices.Insert(p.stages, i+1, stage)
+	return nil
+}
+
+func (p *Pipeline) Replace(name string, stage Stage) error {
+	i, err := p.index(name)
+	if err != nil {
+		return err
+	}
+	p.stages[i] = stage
+	return nil
+}
+
+func (p *Pipeline) index(name string) (int, error) {
+	i := slices.IndexFunc(p.stages, func(s Stage) bool {
+		return s.Name() == name
+	})
+	if i < 0 {
+		return 0, fmt.Errorf("%w %q", ErrUnknownStage, name)
+	}
+	return i, nil
+}
+
+func (p *Pipeline) Run(ctx context.Context, doc *Document) (Report, error) {
+	var report Report
+	for _, stage := range p.stages {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		start := time.Now()
+		err := stage.Process(ctx, doc)
+		report.Stages = append(report.Stages, StageReport{Stage: stage.Name(), Duration: time.Since(start), Err: err})
+		if err != nil {
+			return report, fmt.Errorf("%s stage: %w", stage.Name(), err)
+		}
+	}
+	return report, nil
+}
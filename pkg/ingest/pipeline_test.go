@@ -0,0 +1,177 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tik-choco-lab/rag/pkg/redact"
+	"github.com/tik-choco-lab/rag/pkg/store"
+)
+
+// recordingEmbedder embeds every text as the same vector and records the
+// texts it was asked for.
+type recordingEmbedder struct {
+	texts []string
+}
+
+func (e *recordingEmbedder) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	e.texts = append(e.texts, texts...)
+	embeddings := make([][]float32, len(texts))
+	for i := range texts {
+		embeddings[i] = []float32{1, 0, 0}
+	}
+	return embeddings, nil
+}
+
+func TestPipelineStages(t *testing.T) {
+	r, err := redact.New(redact.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New(Options{})
+	if err := p.InsertAfter(StageClean, Redact(r, "")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.InsertAfter(StageSplit, DetectLanguage("language")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{StageLoad, StageClean, StageRedact, StageSplit, StageLanguage, StageDedup, StageEmbed, StageStore}
+	if got := p.Stages(); !slices.Equal(got, want) {
+		t.Errorf("stages %v, want %v", got, want)
+	}
+
+	if err := p.InsertBefore("enrich", Clean()); !errors.Is(err, ErrUnknownStage) {
+		t.Errorf("inserting before an unknown stage: %v, want ErrUnknownStage", err)
+	}
+	if err := p.Replace(StageLanguage, NewStage("custom", func(ctx context.Context, doc *Document) error { return nil })); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Stages()[4]; got != "custom" {
+		t.Errorf("replaced stage is %q, want custom", got)
+	}
+}
+
+func TestRunStopsAtFailure(t *testing.T) {
+	failure := errors.New("failed")
+	var ran []string
+	stage := func(name string, err error) Stage {
+		return NewStage(name, func(ctx context.Context, doc *Document) error {
+			ran = append(ran, name)
+			return err
+		})
+	}
+
+	report, err := NewPipeline(stage("a", nil), stage("b", failure), stage("c", nil)).Run(context.Background(), &Document{})
+	if !errors.Is(err, failure) || !strings.HasPrefix(err.Error(), "b stage") {
+		t.Errorf("Run = %v, want the error of stage b", err)
+	}
+	if !slices.Equal(ran, []string{"a", "b"}) {
+		t.Errorf("stages run %v, want [a b]", ran)
+	}
+	if len(report.Stages) != 2 || report.Stages[0].Err != nil || !errors.Is(report.Stages[1].Err, failure) {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestDedupSkipsEmbedding(t *testing.T) {
+	shared := strings.Repeat("shared paragraph about vector search ", 3)[:100]
+	first := strings.Repeat("only in the first document, on cooking ", 3)[:100]
+	second := strings.Repeat("only in the second document, on sailing ", 3)[:100]
+
+	for _, action := range []store.DedupAction{store.DedupSkip, store.DedupLink} {
+		ctx := context.Background()
+		s := store.NewJSONStore(filepath.Join(t.TempDir(), "store.json"), store.JSONOptions{})
+		embedder := &recordingEmbedder{}
+		add := store.AddOptions{ChunkSize: 100, Dedup: store.DedupOptions{Method: store.DedupMinHash, Action: action}}
+		p := New(Options{Store: s, Add: add, EmbeddingsFunc: embedder.embed})
+
+		if _, err := p.Run(ctx, &Document{ID: "a", Text: shared + first}); err != nil {
+			t.Fatal(err)
+		}
+		embedder.texts = nil
+
+		var embedded []string
+		if err := p.InsertAfter(StageEmbed, NewStage("check", func(ctx context.Context, doc *Document) error {
+			embedded = slices.Clone(embedder.texts)
+			return nil
+		})); err != nil {
+			t.Fatal(err)
+		}
+		doc := &Document{ID: "b", Text: shared + second}
+		if _, err := p.Run(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+
+		if !slices.Equal(embedded, []string{second}) {
+			t.Errorf("%s: embed stage embedded %q, want only the new chunk", action, embedded)
+		}
+		if want := (store.ChunkRef{DocID: "a", Index: 0}); doc.Chunks[0].DuplicateOf != want {
+			t.Errorf("%s: shared chunk links to %+v, want %+v", action, doc.Chunks[0].DuplicateOf, want)
+		}
+		if doc.Chunks[1].DuplicateOf.DocID != "" {
+			t.Errorf("%s: new chunk links to %+v", action, doc.Chunks[1].DuplicateOf)
+		}
+		if doc.Result.Duplicates != 1 {
+			t.Errorf("%s: result %+v, want one duplicate", action, doc.Result)
+		}
+
+		stored, err := s.GetDocument(ctx, "", "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch action {
+		case store.DedupSkip:
+			if len(embedder.texts) != 1 || len(stored.Chunks) != 1 || stored.Chunks[0].Text != second {
+				t.Errorf("skip: embedded %q and stored %+v, want only the new chunk", embedder.texts, stored.Chunks)
+			}
+		case store.DedupLink:
+			if len(stored.Chunks) != 2 || stored.Chunks[0].DuplicateOf.DocID != "a" {
+				t.Errorf("link: stored %+v, want both chunks with the shared one linked", stored.Chunks)
+			}
+		}
+	}
+}
+
+func TestReaddRedactedDocumentWritesNothing(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := store.NewJSONStore(path, store.JSONOptions{})
+	r, err := redact.New(redact.Options{Key: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedder := &recordingEmbedder{}
+	p := New(Options{Store: s, Add: store.AddOptions{ChunkSize: 100}, EmbeddingsFunc: embedder.embed})
+	if err := p.InsertAfter(StageClean, Redact(r, "pii")); err != nil {
+		t.Fatal(err)
+	}
+
+	const text = "contact taro@example.com or 03-1234-5678"
+	if _, err := p.Run(ctx, &Document{ID: "doc", Text: text}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := &Document{ID: "doc", Text: text}
+	if _, err := p.Run(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("adding the same document again grew the log from %d to %d bytes", before.Size(), after.Size())
+	}
+	if doc.Result.Kept != 1 || doc.Result.Added != 0 || len(embedder.texts) != 1 {
+		t.Errorf("adding again = %+v after embedding %q, want the chunk kept", doc.Result, embedder.texts)
+	}
+}
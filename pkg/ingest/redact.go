@@ -0,0 +1,27 @@
+package ingest
+
+import (
+	"context"
+
+	"github.com/tik-choco-lab/rag/pkg/redact"
+)
+
+const StageRedact = "redact"
+
+// Redact runs before splitting, so PII is neither embedded nor stored.
+func Redact(r *redact.Redactor, mappingKey string) Stage {
+	return NewStage(StageRedact, func(ctx context.Context, doc *Document) error {
+		text, mapping := r.Redact(doc.Text)
+		doc.Text = text
+		if len(mapping) == 0 || !r.Reversible() || mappingKey == "" {
+			return nil
+		}
+		sealed, err := r.Seal(mapping)
+		if err != nil {
+			return err
+		}
+		doc.SetMetadata(mappingKey, sealed)
+		doc.Redacted = mapping
+		return nil
+	})
+}
@@ -0,0 +1,117 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/tik-choco-lab/rag/pkg/content"
+	"github.com/tik-choco-lab/rag/pkg/store"
+)
+
+func Load() Stage {
+	return NewStage(StageLoad, func(ctx context.Context, doc *Document) error {
+		if doc.Text != "" || doc.Source == "" {
+			return nil
+		}
+		text, err := content.ReadTextFile(doc.Source)
+		doc.Text = text
+		return err
+	})
+}
+
+func Clean() Stage {
+	return NewStage(StageClean, func(ctx context.Context, doc *Document) error {
+		doc.Text = content.CleanText(doc.Text)
+		return nil
+	})
+}
+
+func Split(options store.AddOptions) Stage {
+	return NewStage(StageSplit, func(ctx context.Context, doc *Document) error {
+		doc.Hash = content.CalculateHash(doc.Text)
+		if len(doc.Redacted) > 0 {
+			var b strings.Builder
+			b.WriteString(doc.Text)
+			for _, placeholder := range slices.Sorted(maps.Keys(doc.Redacted)) {
+				fmt.Fprintf(&b, "\x00%s\x00%s", placeholder, doc.Redacted[placeholder])
+			}
+			doc.Hash = content.CalculateHash(b.String())
+		}
+		doc.Chunks = store.SplitDocument(doc.Text, options)
+		return nil
+	})
+}
+
+// Embed leaves the chunks Dedup links to the store, which drops them under
+// store.DedupSkip instead of embedding them.
+func Dedup(s store.Store, collection string, options store.DedupOptions) Stage {
+	return NewStage(StageDedup, func(ctx context.Context, doc *Document) error {
+		linker, ok := s.(store.DuplicateLinker)
+		if !ok {
+			return nil
+		}
+		return linker.LinkDuplicates(ctx, collection, doc.ID, doc.Chunks, options)
+	})
+}
+
+func Embed(s store.Store, collection string, embeddingsFunc EmbeddingsFunc) Stage {
+	return NewStage(StageEmbed, func(ctx context.Context, doc *Document) error {
+		stored := make(map[string][][]float32)
+		if s != nil {
+			previous, err := s.GetDocument(ctx, collection, doc.ID)
+			if err != nil && !errors.Is(err, store.ErrNotFound) && !errors.Is(err, store.ErrCollectionNotFound) {
+				return err
+			}
+			if previous != nil {
+				for _, c := range previous.Chunks {
+					stored[c.Hash] = append(stored[c.Hash], c.Embedding)
+				}
+			}
+		}
+
+		var missing []int
+		var texts []string
+		for i, c := range doc.Chunks {
+			if len(c.Embedding) > 0 || c.DuplicateOf.DocID != "" {
+				continue
+			}
+			if embs := stored[c.Hash]; c.Hash != "" && len(embs) > 0 {
+				doc.Chunks[i].Embedding = embs[len(embs)-1]
+				stored[c.Hash] = embs[:len(embs)-1]
+				continue
+			}
+			missing = append(missing, i)
+			texts = append(texts, c.Text)
+		}
+		if len(texts) == 0 {
+			return nil
+		}
+
+		embeddings, err := embeddingsFunc(ctx, texts)
+		if err != nil {
+			return err
+		}
+		if len(embeddings) != len(texts) {
+			return fmt.Errorf("got %d embeddings for %d chunks", len(embeddings), len(texts))
+		}
+		for i, idx := range missing {
+			doc.Chunks[idx].Embedding = embeddings[i]
+		}
+		return nil
+	})
+}
+
+func Store(s store.Store, collection string, options store.AddOptions, embeddingsFunc EmbeddingsFunc) Stage {
+	return NewStage(StageStore, func(ctx context.Context, doc *Document) error {
+		result, err := s.AddChunks(ctx, collection, store.Document{
+			DocumentInfo: store.DocumentInfo{DocID: doc.ID, Hash: doc.Hash, Metadata: doc.Metadata},
+			Chunks:       doc.Chunks,
+		}, options, embeddingsFunc)
+		doc.Result = result
+		return err
+	})
+}
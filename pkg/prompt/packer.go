@@ -0,0 +1,192 @@
+package prompt
+
+import (
+	"slices"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tik-choco-lab/rag/pkg/content"
+)
+
+const (
+	asciiCharsPerToken = 4
+	perMessageTokens   = 4
+	perChunkTokens     = 8
+	minTrimTokens      = 32
+)
+
+type Packer struct {
+	ContextSize    int
+	ReservedTokens int
+	// Overlap is the rune overlap of chunks within one parent. Parent texts
+	// are concatenated as they are.
+	Overlap     int
+	Parents     bool
+	CountTokens func(text string) int
+}
+
+type ChunkRef struct {
+	DocID        string
+	ChunkIndices []int
+	Score        float32
+	Tokens       int
+	Trimmed      bool
+}
+
+type PackResult struct {
+	Results  []content.SearchResult
+	Included []ChunkRef
+	Dropped  []ChunkRef
+	Tokens   int
+}
+
+func NewPacker(contextSize, reservedTokens, overlap int) Packer {
+	return Packer{
+		ContextSize:    contextSize,
+		ReservedTokens: reservedTokens,
+		Overlap:        overlap,
+		CountTokens:    EstimateTokens,
+	}
+}
+
+// EstimateTokens counts four ASCII characters or one other character as a
+// token.
+func EstimateTokens(text string) int {
+	var ascii, other int
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+asciiCharsPerToken-1)/asciiCharsPerToken + other
+}
+
+func (p Packer) CountMessages(msgs []openai.ChatCompletionMessage) int {
+	var n int
+	for _, m := range msgs {
+		n += p.count(m.Content) + perMessageTokens
+	}
+	return n
+}
+
+func (p Packer) Pack(results []content.SearchResult, overhead int) PackResult {
+	budget := p.ContextSize - p.ReservedTokens - overhead
+
+	var packed PackResult
+	for _, g := range p.mergeAdjacent(results) {
+		ref := g.ref
+		header := p.count(g.result.DocID) + perChunkTokens
+		ref.Tokens = p.count(g.result.Text) + header
+
+		remaining := budget - packed.Tokens
+		if ref.Tokens <= remaining {
+			packed.Results = append(packed.Results, g.result)
+			packed.Included = append(packed.Included, ref)
+			packed.Tokens += ref.Tokens
+			continue
+		}
+
+		if len(packed.Dropped) == 0 && remaining-header >= minTrimTokens {
+			res := g.result
+			res.Text = p.trim(res.Text, remaining-header)
+			ref.Tokens = p.count(res.Text) + header
+			ref.Trimmed = true
+			packed.Results = append(packed.Results, res)
+			packed.Included = append(packed.Included, ref)
+			packed.Tokens += ref.Tokens
+			budget = packed.Tokens
+			continue
+		}
+
+		packed.Dropped = append(packed.Dropped, ref)
+	}
+	return packed
+}
+
+func (p Packer) count(text string) int {
+	if p.CountTokens == nil {
+		return EstimateTokens(text)
+	}
+	return p.CountTokens(text)
+}
+
+func (p Packer) trim(text string, maxTokens int) string {
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if p.count(string(runes[:mid])) <= maxTokens {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return string(runes[:lo])
+}
+
+type group struct {
+	result content.SearchResult
+	ref    ChunkRef
+	last   int
+}
+
+func (p Packer) position(res content.SearchResult) int {
+	if p.Parents {
+		return res.ParentIndex
+	}
+	return res.ChunkIndex
+}
+
+func (p Packer) mergeAdjacent(results []content.SearchResult) []group {
+	sorted := slices.Clone(results)
+	slices.SortStableFunc(sorted, func(a, b content.SearchResult) int {
+		if a.DocID != b.DocID {
+			if a.DocID < b.DocID {
+				return -1
+			}
+			return 1
+		}
+		return p.position(a) - p.position(b)
+	})
+
+	var groups []group
+	for _, res := range sorted {
+		if n := len(groups); n > 0 {
+			last := &groups[n-1]
+			if last.result.DocID == res.DocID && last.last+1 == p.position(res) && (p.Parents || last.result.ParentIndex == res.ParentIndex) {
+				if p.Parents {
+					last.result.Text += res.Text
+				} else {
+					last.result.Text = content.MergeOverlap(last.result.Text, res.Text, p.Overlap)
+				}
+				last.result.Score = max(last.result.Score, res.Score)
+				last.ref.Score = last.result.Score
+				last.ref.ChunkIndices = append(last.ref.ChunkIndices, res.ChunkIndex)
+				last.last = p.position(res)
+				continue
+			}
+		}
+		groups = append(groups, group{
+			result: res,
+			last:   p.position(res),
+			ref: ChunkRef{
+				DocID:        res.DocID,
+				ChunkIndices: []int{res.ChunkIndex},
+				Score:        res.Score,
+			},
+		})
+	}
+
+	slices.SortStableFunc(groups, func(a, b group) int {
+		if a.result.Score > b.result.Score {
+			return -1
+		}
+		if a.result.Score < b.result.Score {
+			return 1
+		}
+		return 0
+	})
+	return groups
+}
@@ -0,0 +1,158 @@
+package prompt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tik-choco-lab/rag/pkg/content"
+)
+
+func countRunes(text string) int {
+	return len([]rune(text))
+}
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"abcd", 1},
+		{"abcde", 2},
+		{"日本語", 3},
+		{"ab日本", 3},
+	}
+	for _, tt := range tests {
+		if got := EstimateTokens(tt.text); got != tt.want {
+			t.Errorf("EstimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPack(t *testing.T) {
+	long := strings.Repeat("x", 60)
+	tests := []struct {
+		name        string
+		packer      Packer
+		results     []content.SearchResult
+		wantTexts   []string
+		wantChunks  [][]int
+		wantDropped [][]int
+		wantTrimmed bool
+	}{
+		{
+			name:   "ordered by score",
+			packer: Packer{ContextSize: 1000},
+			results: []content.SearchResult{
+				{DocID: "a", ChunkIndex: 5, Text: "low", Score: 0.2},
+				{DocID: "b", ChunkIndex: 0, Text: "high", Score: 0.9},
+				{DocID: "a", ChunkIndex: 0, Text: "mid", Score: 0.5},
+			},
+			wantTexts:  []string{"high", "mid", "low"},
+			wantChunks: [][]int{{0}, {0}, {5}},
+		},
+		{
+			name:   "adjacent chunks merge on the overlap",
+			packer: Packer{ContextSize: 1000, Overlap: 2},
+			results: []content.SearchResult{
+				{DocID: "a", ChunkIndex: 1, Text: "efgh", Score: 0.8},
+				{DocID: "a", ChunkIndex: 0, Text: "abcdef", Score: 0.3},
+				{DocID: "a", ChunkIndex: 3, Text: "zz", Score: 0.5},
+			},
+			wantTexts:  []string{"abcdefgh", "zz"},
+			wantChunks: [][]int{{0, 1}, {3}},
+		},
+		{
+			name:   "chunks of different parents are not merged",
+			packer: Packer{ContextSize: 1000, Overlap: 2},
+			results: []content.SearchResult{
+				{DocID: "a", ChunkIndex: 1, ParentIndex: 0, Text: "end of first", Score: 0.8},
+				{DocID: "a", ChunkIndex: 2, ParentIndex: 1, Text: "start of second", Score: 0.6},
+			},
+			wantTexts:  []string{"end of first", "start of second"},
+			wantChunks: [][]int{{1}, {2}},
+		},
+		{
+			name:   "parents are concatenated",
+			packer: Packer{ContextSize: 1000, Overlap: 2, Parents: true},
+			results: []content.SearchResult{
+				{DocID: "a", ChunkIndex: 4, ParentIndex: 1, Text: "second parent", Score: 0.4},
+				{DocID: "a", ChunkIndex: 0, ParentIndex: 0, Text: "first parent ", Score: 0.7},
+			},
+			wantTexts:  []string{"first parent second parent"},
+			wantChunks: [][]int{{0, 4}},
+		},
+		{
+			name:   "overflow is trimmed once and the rest dropped",
+			packer: Packer{ContextSize: 120, ReservedTokens: 10},
+			results: []content.SearchResult{
+				{DocID: "a", ChunkIndex: 0, Text: long, Score: 0.9},
+				{DocID: "b", ChunkIndex: 0, Text: long, Score: 0.8},
+				{DocID: "c", ChunkIndex: 0, Text: "tiny", Score: 0.7},
+			},
+			// 110 tokens of budget: 69 for the first, 41 left for the second,
+			// whose text is trimmed to 32 after its 9 token header.
+			wantTexts:   []string{long, long[:32]},
+			wantChunks:  [][]int{{0}, {0}},
+			wantDropped: [][]int{{0}},
+			wantTrimmed: true,
+		},
+		{
+			name:   "too little room to trim",
+			packer: Packer{ContextSize: 100},
+			results: []content.SearchResult{
+				{DocID: "a", ChunkIndex: 0, Text: long, Score: 0.9},
+				{DocID: "b", ChunkIndex: 0, Text: long, Score: 0.8},
+			},
+			wantTexts:   []string{long},
+			wantChunks:  [][]int{{0}},
+			wantDropped: [][]int{{0}},
+		},
+	}
+	for _, tt := range tests {
+		tt.packer.CountTokens = countRunes
+		packed := tt.packer.Pack(tt.results, 0)
+
+		var texts []string
+		var chunks, dropped [][]int
+		var trimmed bool
+		tokens := 0
+		for i, res := range packed.Results {
+			texts = append(texts, res.Text)
+			chunks = append(chunks, packed.Included[i].ChunkIndices)
+			trimmed = trimmed || packed.Included[i].Trimmed
+			tokens += packed.Included[i].Tokens
+		}
+		for _, ref := range packed.Dropped {
+			dropped = append(dropped, ref.ChunkIndices)
+		}
+
+		if !reflect.DeepEqual(texts, tt.wantTexts) {
+			t.Errorf("%s: texts = %q, want %q", tt.name, texts, tt.wantTexts)
+		}
+		if !reflect.DeepEqual(chunks, tt.wantChunks) {
+			t.Errorf("%s: chunks = %v, want %v", tt.name, chunks, tt.wantChunks)
+		}
+		if !reflect.DeepEqual(dropped, tt.wantDropped) {
+			t.Errorf("%s: dropped = %v, want %v", tt.name, dropped, tt.wantDropped)
+		}
+		if trimmed != tt.wantTrimmed {
+			t.Errorf("%s: trimmed = %v, want %v", tt.name, trimmed, tt.wantTrimmed)
+		}
+		if budget := tt.packer.ContextSize - tt.packer.ReservedTokens; packed.Tokens != tokens || packed.Tokens > budget {
+			t.Errorf("%s: %d tokens packed, included add up to %d, budget %d", tt.name, packed.Tokens, tokens, budget)
+		}
+	}
+}
+
+func TestPackOverhead(t *testing.T) {
+	p := Packer{ContextSize: 100, CountTokens: countRunes}
+	results := []content.SearchResult{{DocID: "a", Text: strings.Repeat("x", 50)}}
+	if packed := p.Pack(results, 0); len(packed.Results) != 1 {
+		t.Fatalf("without overhead packed %d results", len(packed.Results))
+	}
+	if packed := p.Pack(results, 70); len(packed.Results) != 0 || len(packed.Dropped) != 1 {
+		t.Errorf("with overhead packed %d results and dropped %d", len(packed.Results), len(packed.Dropped))
+	}
+}
@@ -0,0 +1,149 @@
+package prompt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tik-choco-lab/rag/pkg/content"
+)
+
+const (
+	dateLayout = "2006-01-02"
+
+	defaultAnswerTemplate    = "以下の資料を参考に、質問に答えてください。\n\n# 資料\n{{range .Results}}{{.Text}}\n---\n{{end}}\n\n# 質問\n{{.Query}}"
+	defaultNoResultsTemplate = "資料が見つかりませんでした。以下の質問にあなたの知識で答えてください。\n\n# 質問\n{{.Query}}"
+)
+
+var funcs = template.FuncMap{
+	"add":  func(a, b int) int { return a + b },
+	"join": strings.Join,
+}
+
+type Files struct {
+	System    string
+	Answer    string
+	NoResults string
+}
+
+type Data struct {
+	Query   string
+	Results []content.SearchResult
+	History []openai.ChatCompletionMessage
+	Date    string
+}
+
+type Templates struct {
+	system    *template.Template
+	answer    *template.Template
+	noResults *template.Template
+}
+
+func Load(files Files) (*Templates, error) {
+	system, err := parse("system", files.System, "")
+	if err != nil {
+		return nil, err
+	}
+	answer, err := parse("answer", files.Answer, defaultAnswerTemplate)
+	if err != nil {
+		return nil, err
+	}
+	noResults, err := parse("no_results", files.NoResults, defaultNoResultsTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Templates{
+		system:    system,
+		answer:    answer,
+		noResults: noResults,
+	}, nil
+}
+
+func NewData(query string, results []content.SearchResult, history []openai.ChatCompletionMessage) Data {
+	return Data{
+		Query:   query,
+		Results: results,
+		History: history,
+		Date:    time.Now().Format(dateLayout),
+	}
+}
+
+func (t *Templates) Build(data Data) ([]openai.ChatCompletionMessage, error) {
+	if len(data.Results) == 0 {
+		return t.build(data, t.noResults)
+	}
+	return t.build(data, t.answer)
+}
+
+func (t *Templates) Overhead(data Data, packer Packer) (int, error) {
+	data.Results = nil
+	msgs, err := t.build(data, t.answer)
+	if err != nil {
+		return 0, err
+	}
+	return packer.CountMessages(msgs), nil
+}
+
+func (t *Templates) build(data Data, body *template.Template) ([]openai.ChatCompletionMessage, error) {
+	var msgs []openai.ChatCompletionMessage
+
+	system, err := execute(t.system, data)
+	if err != nil {
+		return nil, err
+	}
+	if system != "" {
+		msgs = append(msgs, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: system,
+		})
+	}
+
+	msgs = append(msgs, data.History...)
+
+	user, err := execute(body, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(msgs, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: user,
+	}), nil
+}
+
+func parse(name, path, fallback string) (*template.Template, error) {
+	text := fallback
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s template: %w", name, err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+func execute(tmpl *template.Template, data Data) (string, error) {
+	if tmpl == nil {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute %s template: %w", tmpl.Name(), err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
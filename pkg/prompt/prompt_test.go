@@ -0,0 +1,137 @@
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/tik-choco-lab/rag/pkg/content"
+)
+
+func writeTemplate(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "prompt.tmpl")
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBuild(t *testing.T) {
+	results := []content.SearchResult{
+		{DocID: "a", Text: "first", Score: 0.9, Metadata: map[string]string{"version": "v2"}},
+		{DocID: "b", Text: "second", Score: 0.5},
+	}
+	history := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "earlier"}}
+
+	tests := []struct {
+		name    string
+		files   Files
+		data    Data
+		want    []openai.ChatCompletionMessage
+		wantErr bool
+	}{
+		{
+			name:  "defaults without results",
+			files: Files{},
+			data:  Data{Query: "q"},
+			want: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "資料が見つかりませんでした。以下の質問にあなたの知識で答えてください。\n\n# 質問\nq"},
+			},
+		},
+		{
+			name:  "defaults with results",
+			files: Files{},
+			data:  Data{Query: "q", Results: results},
+			want: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "以下の資料を参考に、質問に答えてください。\n\n# 資料\nfirst\n---\nsecond\n---\n\n\n# 質問\nq"},
+			},
+		},
+		{
+			name: "system, history and funcs",
+			files: Files{
+				System: writeTemplate(t, "  today is {{.Date}}\n"),
+				Answer: writeTemplate(t, `{{range $i, $r := .Results}}[{{add $i 1}}] {{$r.DocID}}{{with $r.Metadata.version}} ({{.}}){{end}} {{printf "%.1f" $r.Score}}
+{{end}}{{.Query}}`),
+			},
+			data: Data{Query: "q", Results: results, History: history, Date: "2026-01-02"},
+			want: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleSystem, Content: "today is 2026-01-02"},
+				history[0],
+				{Role: openai.ChatMessageRoleUser, Content: "[1] a (v2) 0.9\n[2] b 0.5\nq"},
+			},
+		},
+		{
+			name:    "execution error",
+			files:   Files{Answer: writeTemplate(t, "{{index .Results 5}}")},
+			data:    Data{Query: "q", Results: results},
+			wantErr: true,
+		},
+		{
+			name:  "empty system is left out",
+			files: Files{System: writeTemplate(t, "{{if .History}}history{{end}}"), NoResults: writeTemplate(t, "none: {{.Query}}")},
+			data:  Data{Query: "q"},
+			want: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleUser, Content: "none: q"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		templates, err := Load(tt.files)
+		if err != nil {
+			t.Fatalf("%s: Load: %v", tt.name, err)
+		}
+		got, err := templates.Build(tt.data)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: Build succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Build: %v", tt.name, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: Build = %+v, want %+v", tt.name, got, tt.want)
+		}
+		for i := range got {
+			if got[i].Role != tt.want[i].Role || got[i].Content != tt.want[i].Content {
+				t.Errorf("%s: message %d = %q %q, want %q %q", tt.name, i, got[i].Role, got[i].Content, tt.want[i].Role, tt.want[i].Content)
+			}
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, files := range map[string]Files{
+		"missing file": {Answer: filepath.Join(t.TempDir(), "missing.tmpl")},
+		"parse error":  {System: writeTemplate(t, "{{.Query")},
+		"unknown func": {NoResults: writeTemplate(t, "{{upper .Query}}")},
+	} {
+		if _, err := Load(files); err == nil {
+			t.Errorf("%s: Load succeeded", name)
+		}
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	templates, err := Load(Files{
+		System: writeTemplate(t, "system"),
+		Answer: writeTemplate(t, "{{range .Results}}{{.Text}}{{end}}question: {{.Query}}"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packer := Packer{CountTokens: func(text string) int { return len([]rune(text)) }}
+	data := Data{Query: "q", Results: []content.SearchResult{{Text: strings.Repeat("x", 100)}}}
+
+	got, err := templates.Overhead(data, packer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len("system") + len("question: q") + 2*perMessageTokens; got != want {
+		t.Errorf("Overhead = %d, want %d", got, want)
+	}
+}
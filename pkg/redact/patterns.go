@@ -0,0 +1,105 @@
+package redact
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Japanese text often writes numbers with full-width digits and assorted
+// dashes, so the patterns accept both.
+const (
+	digitClass = `[0-9０-９]`
+	dashes     = `‐‑–－−-`
+	spaces     = ` 　`
+)
+
+var builtins = []detector{
+	{kind: Email, re: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)},
+	{kind: CreditCard, re: pattern(`D(?:[ H]?D){12,18}`), numeric: true, valid: luhn},
+	{kind: MyNumber, re: pattern(`D{4}[ H]?D{4}[ H]?D{4}`), numeric: true, valid: myNumberCheck},
+	{kind: Phone, re: pattern(`\+D{1,3}[ H]?(?:\(Z\)[ ]?)?D{1,4}[ H]?D{1,4}[ H]?D{3,4}|\(?ZD{1,4}\)?[ H]?D{1,4}[ H]?D{3,4}|ZD{1,4}[(（]D{1,4}[)）]D{4}`), numeric: true, valid: phoneNumber},
+	{kind: PostalCode, re: pattern(`〒S?D{3}H?D{4}|D{3}HD{4}`), numeric: true},
+}
+
+// pattern expands D to a digit, Z to a zero, H to a dash, [ H] to a space or
+// dash and S to a space in expr.
+func pattern(expr string) *regexp.Regexp {
+	return regexp.MustCompile(strings.NewReplacer(
+		"[ H]", "[ "+dashes+"]",
+		"H", "["+dashes+"]",
+		"D", digitClass,
+		"Z", "[0０]",
+		"S", "["+spaces+"]",
+	).Replace(expr))
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9' || r >= '０' && r <= '９'
+}
+
+func isDash(r rune) bool {
+	return strings.ContainsRune(dashes, r)
+}
+
+func digits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r >= '０' && r <= '９':
+			b.WriteRune(r - '０' + '0')
+		}
+	}
+	return b.String()
+}
+
+func luhn(value string) bool {
+	digits := digits(value)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range len(digits) {
+		n := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if n *= 2; n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
+
+// myNumberCheck verifies the check digit of a 12-digit Individual Number.
+func myNumberCheck(value string) bool {
+	digits := digits(value)
+	if len(digits) != 12 {
+		return false
+	}
+	sum := 0
+	for n := 1; n <= 11; n++ {
+		p := int(digits[11-n] - '0')
+		q := n + 1
+		if n > 6 {
+			q = n - 5
+		}
+		sum += p * q
+	}
+	check := 0
+	if r := sum % 11; r > 1 {
+		check = 11 - r
+	}
+	return int(digits[11]-'0') == check
+}
+
+// phoneNumber accepts international numbers of 8 to 15 digits and domestic
+// ones of 10 or 11 digits starting with 0.
+func phoneNumber(value string) bool {
+	digits := digits(value)
+	if strings.HasPrefix(value, "+") {
+		return len(digits) >= 8 && len(digits) <= 15
+	}
+	return strings.HasPrefix(digits, "0") && (len(digits) == 10 || len(digits) == 11)
+}
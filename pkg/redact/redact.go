@@ -0,0 +1,242 @@
+package redact
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+type Kind string
+
+const (
+	Email      Kind = "EMAIL"
+	Phone      Kind = "PHONE"
+	CreditCard Kind = "CREDIT_CARD"
+	PostalCode Kind = "POSTAL_CODE"
+	MyNumber   Kind = "MY_NUMBER"
+)
+
+var (
+	ErrNoKey         = errors.New("redaction mapping key not set")
+	errInvalidSealed = errors.New("invalid sealed mapping")
+
+	// kindName keeps custom kinds usable inside placeholders.
+	kindName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+)
+
+// Patterns that can match the empty string are rejected.
+type Pattern struct {
+	Kind    Kind
+	Pattern string
+}
+
+type Options struct {
+	Kinds  []Kind
+	Custom []Pattern
+	// Key must be 16, 24 or 32 bytes long.
+	Key []byte
+}
+
+type Match struct {
+	Kind  Kind
+	Start int
+	End   int
+	Value string
+}
+
+type Redactor struct {
+	detectors []detector
+	aead      cipher.AEAD
+	nonceKey  []byte
+}
+
+func New(options Options) (*Redactor, error) {
+	for _, kind := range options.Kinds {
+		if !slices.ContainsFunc(builtins, func(d detector) bool { return d.kind == kind }) {
+			return nil, fmt.Errorf("unknown redaction kind %q", kind)
+		}
+	}
+
+	r := &Redactor{}
+	for _, p := range options.Custom {
+		if !kindName.MatchString(string(p.Kind)) {
+			return nil, fmt.Errorf("invalid redaction pattern kind %q", p.Kind)
+		}
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %s: %w", p.Kind, err)
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("redaction pattern %s matches the empty string", p.Kind)
+		}
+		r.detectors = append(r.detectors, detector{kind: p.Kind, re: re})
+	}
+	for _, d := range builtins {
+		if len(options.Kinds) == 0 || slices.Contains(options.Kinds, d.kind) {
+			r.detectors = append(r.detectors, d)
+		}
+	}
+
+	if options.Key != nil {
+		block, err := aes.NewCipher(options.Key)
+		if err != nil {
+			return nil, fmt.Errorf("redaction key: %w", err)
+		}
+		if r.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, options.Key)
+		mac.Write([]byte("nonce"))
+		r.nonceKey = mac.Sum(nil)
+	}
+	return r, nil
+}
+
+func (r *Redactor) Reversible() bool {
+	return r.aead != nil
+}
+
+// Where matches overlap, custom patterns win over built-in ones and earlier
+// detectors over later ones.
+func (r *Redactor) Find(text string) []Match {
+	var matches []Match
+	for _, d := range r.detectors {
+		for _, m := range d.find(text) {
+			if !slices.ContainsFunc(matches, func(o Match) bool {
+				return m.Start < o.End && o.Start < m.End
+			}) {
+				matches = append(matches, m)
+			}
+		}
+	}
+	slices.SortFunc(matches, func(a, b Match) int {
+		return a.Start - b.Start
+	})
+	return matches
+}
+
+func (r *Redactor) Redact(text string) (string, map[string]string) {
+	matches := r.Find(text)
+	if len(matches) == 0 {
+		return text, nil
+	}
+
+	mapping := make(map[string]string)
+	placeholders := make(map[Match]string)
+	counts := make(map[Kind]int)
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		key := Match{Kind: m.Kind, Value: m.Value}
+		placeholder, ok := placeholders[key]
+		if !ok {
+			counts[m.Kind]++
+			placeholder = fmt.Sprintf("[%s_%d]", m.Kind, counts[m.Kind])
+			placeholders[key] = placeholder
+			mapping[placeholder] = m.Value
+		}
+		b.WriteString(text[last:m.Start])
+		b.WriteString(placeholder)
+		last = m.End
+	}
+	b.WriteString(text[last:])
+	return b.String(), mapping
+}
+
+func Restore(text string, mapping map[string]string) string {
+	pairs := make([]string, 0, len(mapping)*2)
+	for placeholder, value := range mapping {
+		pairs = append(pairs, placeholder, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// Seal derives the nonce from the mapping, so the same mapping always seals
+// the same way.
+func (r *Redactor) Seal(mapping map[string]string) (string, error) {
+	if r.aead == nil {
+		return "", ErrNoKey
+	}
+	plain, err := json.Marshal(mapping)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, r.nonceKey)
+	mac.Write(plain)
+	nonce := mac.Sum(nil)[:r.aead.NonceSize()]
+	return base64.StdEncoding.EncodeToString(r.aead.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func (r *Redactor) Open(sealed string) (map[string]string, error) {
+	if r.aead == nil {
+		return nil, ErrNoKey
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSealed, err)
+	}
+	if len(data) < r.aead.NonceSize() {
+		return nil, errInvalidSealed
+	}
+	nonce, ciphertext := data[:r.aead.NonceSize()], data[r.aead.NonceSize():]
+	plain, err := r.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSealed, err)
+	}
+	var mapping map[string]string
+	err = json.Unmarshal(plain, &mapping)
+	return mapping, err
+}
+
+type detector struct {
+	kind Kind
+	re   *regexp.Regexp
+	// numeric matches must not run on into further digits, directly or
+	// across a dash, and valid checks each match.
+	numeric bool
+	valid   func(value string) bool
+}
+
+func (d detector) find(text string) []Match {
+	var matches []Match
+	for _, loc := range d.re.FindAllStringIndex(text, -1) {
+		value := text[loc[0]:loc[1]]
+		if d.numeric && (continuesNumber(text[:loc[0]], true) || continuesNumber(text[loc[1]:], false)) {
+			continue
+		}
+		if d.valid != nil && !d.valid(value) {
+			continue
+		}
+		matches = append(matches, Match{Kind: d.kind, Start: loc[0], End: loc[1], Value: value})
+	}
+	return matches
+}
+
+func continuesNumber(side string, before bool) bool {
+	next := utf8.DecodeRuneInString
+	if before {
+		next = utf8.DecodeLastRuneInString
+	}
+	r, size := next(side)
+	if isDigit(r) {
+		return true
+	}
+	if !isDash(r) {
+		return false
+	}
+	if before {
+		r, _ = next(side[:len(side)-size])
+	} else {
+		r, _ = next(side[size:])
+	}
+	return isDigit(r)
+}
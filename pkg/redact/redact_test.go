@@ -0,0 +1,192 @@
+package redact
+
+import (
+	"errors"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestLuhn(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"4111111111111111", true},
+		{"4111 1111 1111 1111", true},
+		{"４１１１１１１１１１１１１１１１", true},
+		{"378282246310005", true},
+		{"4111111111111112", false},
+		{"411111111111", false},
+		{"41111111111111111111", false},
+	}
+	for _, tt := range tests {
+		if got := luhn(tt.value); got != tt.want {
+			t.Errorf("luhn(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestMyNumberCheck(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"123456789018", true},
+		{"1234-5678-9018", true},
+		{"１２３４５６７８９０１８", true},
+		{"000000000000", true},
+		{"123456789019", false},
+		{"12345678901", false},
+		{"1234567890180", false},
+	}
+	for _, tt := range tests {
+		if got := myNumberCheck(tt.value); got != tt.want {
+			t.Errorf("myNumberCheck(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestContinuesNumber(t *testing.T) {
+	tests := []struct {
+		side   string
+		before bool
+		want   bool
+	}{
+		{"", true, false},
+		{"", false, false},
+		{"tel 1", true, true},
+		{"1 more", false, true},
+		{"no. ", true, false},
+		{" apples", false, false},
+		{"ID 12-", true, true},
+		{"-34", false, true},
+		{"１－", true, true},
+		{"－９", false, true},
+		{"range -", true, false},
+		{"- to", false, false},
+		{"-", true, false},
+		{"-", false, false},
+	}
+	for _, tt := range tests {
+		if got := continuesNumber(tt.side, tt.before); got != tt.want {
+			t.Errorf("continuesNumber(%q, %v) = %v, want %v", tt.side, tt.before, got, tt.want)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	r, err := New(Options{Custom: []Pattern{{Kind: "EMPLOYEE_ID", Pattern: `EMP-\d{5}`}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"mail taro@example.co.jp or taro@example.co.jp", "mail [EMAIL_1] or [EMAIL_1]"},
+		{"card 4111-1111-1111-1111 paid", "card [CREDIT_CARD_1] paid"},
+		{"card 4111-1111-1111-1112 paid", "card 4111-1111-1111-1112 paid"},
+		{"マイナンバー 1234 5678 9018", "マイナンバー [MY_NUMBER_1]"},
+		{"電話 03-1234-5678、+81 90-1234-5678", "電話 [PHONE_1]、[PHONE_2]"},
+		{"〒100-0001 東京都", "[POSTAL_CODE_1] 東京都"},
+		{"order 12100-00011", "order 12100-00011"},
+		{"staff EMP-12345", "staff [EMPLOYEE_ID_1]"},
+		{"nothing to hide", "nothing to hide"},
+	}
+	for _, tt := range tests {
+		redacted, mapping := r.Redact(tt.text)
+		if redacted != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.text, redacted, tt.want)
+		}
+		if restored := Restore(redacted, mapping); restored != tt.text {
+			t.Errorf("Restore(%q) = %q, want %q", redacted, restored, tt.text)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	r, err := New(Options{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := map[string]string{"[EMAIL_1]": "taro@example.com", "[PHONE_1]": "03-1234-5678"}
+
+	for _, m := range []map[string]string{mapping, {}} {
+		sealed, err := r.Seal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(sealed, "taro") {
+			t.Errorf("sealed mapping %q contains the plain text", sealed)
+		}
+		opened, err := r.Open(sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(opened, m) {
+			t.Errorf("Open = %v, want %v", opened, m)
+		}
+	}
+
+	sealed, err := r.Seal(mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := r.Seal(map[string]string{"[PHONE_1]": "03-1234-5678", "[EMAIL_1]": "taro@example.com"}); err != nil || again != sealed {
+		t.Errorf("sealing the same mapping again = %q, %v, want %q", again, err, sealed)
+	}
+	if changed, err := r.Seal(map[string]string{"[EMAIL_1]": "jiro@example.com", "[PHONE_1]": "03-1234-5678"}); err != nil || changed == sealed {
+		t.Errorf("sealing a changed mapping = %q, %v, want a different seal", changed, err)
+	}
+	other, err := New(Options{Key: []byte(strings.Repeat("x", 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]string{
+		"other key":  sealed,
+		"tampered":   "A" + sealed[1:],
+		"not base64": "!!",
+		"too short":  "AAAA",
+	} {
+		opener := r
+		if name == "other key" {
+			opener = other
+		}
+		if _, err := opener.Open(s); !errors.Is(err, errInvalidSealed) {
+			t.Errorf("%s: Open = %v, want errInvalidSealed", name, err)
+		}
+	}
+
+	plain, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Seal(mapping); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Seal without a key = %v, want ErrNoKey", err)
+	}
+	if _, err := plain.Open(sealed); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Open without a key = %v, want ErrNoKey", err)
+	}
+}
+
+func TestNewRejectsInvalidOptions(t *testing.T) {
+	for name, options := range map[string]Options{
+		"unknown kind":      {Kinds: []Kind{"EMAILS"}},
+		"lower case kind":   {Kinds: []Kind{"email"}},
+		"empty custom kind": {Custom: []Pattern{{Pattern: `x+`}}},
+		"bracket in kind":   {Custom: []Pattern{{Kind: "ID]", Pattern: `x+`}}},
+		"empty match":       {Custom: []Pattern{{Kind: "ID", Pattern: `x*`}}},
+		"empty pattern":     {Custom: []Pattern{{Kind: "ID", Pattern: ``}}},
+		"invalid pattern":   {Custom: []Pattern{{Kind: "ID", Pattern: `(`}}},
+		"short key":         {Key: []byte("short")},
+	} {
+		if _, err := New(options); err == nil {
+			t.Errorf("%s: New accepted %+v", name, options)
+		}
+	}
+	if _, err := New(Options{Kinds: []Kind{Email, Phone}, Custom: []Pattern{{Kind: "Employee_ID2", Pattern: `E\d+`}}}); err != nil {
+		t.Errorf("valid options: %v", err)
+	}
+}
@@ -0,0 +1,387 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"unsafe"
+)
+
+type VectorType string
+
+const (
+	VectorFloat32 VectorType = "float32"
+	VectorFloat16 VectorType = "float16"
+)
+
+const (
+	binaryMagic       = "RAGV"
+	binaryVersion     = 1
+	binaryHeaderSize  = 64
+	binaryBlockAlign  = 64
+	dtypeCodeFloat32  = 1
+	dtypeCodeFloat16  = 2
+	float32ByteLength = 4
+	float16ByteLength = 2
+
+	binaryEntryMagic      = 0xb1
+	binaryEntryHeaderSize = 9
+)
+
+var (
+	errInvalidBinaryStore = errors.New("invalid binary store file")
+	errInvalidLogRecord   = errors.New("invalid log record")
+
+	littleEndianHost = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+)
+
+type snapshotCodec interface {
+	encode(records []record) ([]byte, error)
+	decode(data []byte) ([]record, error)
+	load(path string) ([]record, func() error, error)
+	encodeEntry(e walEntry) ([]byte, error)
+	// decodeEntry returns a length of 0 for a torn final entry.
+	decodeEntry(data []byte) (walEntry, int, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(records []record) ([]byte, error) {
+	return json.MarshalIndent(records, "", "  ")
+}
+
+func (jsonCodec) decode(data []byte) ([]record, error) {
+	var records []record
+	err := json.Unmarshal(data, &records)
+	return records, err
+}
+
+func (c jsonCodec) load(path string) ([]record, func() error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, err := c.decode(data)
+	return records, nil, err
+}
+
+func (jsonCodec) encodeEntry(e walEntry) ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func (jsonCodec) decodeEntry(data []byte) (walEntry, int, error) {
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return walEntry{}, 0, nil
+	}
+	var e walEntry
+	if err := json.Unmarshal(data[:end], &e); err != nil {
+		return walEntry{}, 0, err
+	}
+	return e, end + 1, nil
+}
+
+// binaryCodec writes snapshots as a header, a 64-byte aligned block of
+// little-endian vectors that can be mapped in place and a JSON section:
+//
+//	header:  magic[4] version:u16 dtype:u16 dim:u32 pad:u32
+//	         count:u64 vectorOffset:u64 metaOffset:u64 metaLength:u64
+//
+// Log entries carry their records in the same layout:
+//
+//	entry:   magic:u8 length:u32 crc32:u32 payload[length]
+//	payload: op docID metadata (each length:u32 bytes) records
+type binaryCodec struct {
+	vectorType VectorType
+}
+
+func (c binaryCodec) encode(records []record) ([]byte, error) {
+	code, elemSize, err := dtypeOf(c.vectorType)
+	if err != nil {
+		return nil, err
+	}
+
+	var dim int
+	if len(records) > 0 {
+		dim = len(records[0].Embedding)
+	}
+	meta := make([]record, len(records))
+	for i, r := range records {
+		if len(r.Embedding) != dim {
+			return nil, fmt.Errorf("record %d of %q has dimension %d, expected %d", r.ChunkIndex, r.DocID, len(r.Embedding), dim)
+		}
+		meta[i] = r
+		meta[i].Embedding = nil
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	vectorOffset := alignUp(binaryHeaderSize)
+	vectorLength := len(records) * dim * elemSize
+	metaOffset := alignUp(vectorOffset + vectorLength)
+
+	buf := make([]byte, metaOffset+len(metaJSON))
+	copy(buf, binaryMagic)
+	binary.LittleEndian.PutUint16(buf[4:], binaryVersion)
+	binary.LittleEndian.PutUint16(buf[6:], code)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(dim))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(len(records)))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(vectorOffset))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(metaOffset))
+	binary.LittleEndian.PutUint64(buf[40:], uint64(len(metaJSON)))
+
+	off := vectorOffset
+	for _, r := range records {
+		for _, v := range r.Embedding {
+			if code == dtypeCodeFloat16 {
+				binary.LittleEndian.PutUint16(buf[off:], float32ToFloat16(v))
+			} else {
+				binary.LittleEndian.PutUint32(buf[off:], math.Float32bits(v))
+			}
+			off += elemSize
+		}
+	}
+	copy(buf[metaOffset:], metaJSON)
+	return buf, nil
+}
+
+func (c binaryCodec) decode(data []byte) ([]record, error) {
+	records, _, err := c.decodeRecords(data)
+	return records, err
+}
+
+// load reads float32 vectors in place from the mapping, which release unmaps.
+func (c binaryCodec) load(path string) ([]record, func() error, error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, mapped, err := c.decodeRecords(data)
+	if err != nil || !mapped {
+		return records, nil, errors.Join(err, release())
+	}
+	return records, release, nil
+}
+
+// decodeRecords reports whether the embeddings point into data.
+func (c binaryCodec) decodeRecords(data []byte) ([]record, bool, error) {
+	if len(data) < binaryHeaderSize || string(data[:4]) != binaryMagic {
+		return nil, false, errInvalidBinaryStore
+	}
+	if v := binary.LittleEndian.Uint16(data[4:]); v != binaryVersion {
+		return nil, false, fmt.Errorf("unsupported binary store version %d", v)
+	}
+
+	code := binary.LittleEndian.Uint16(data[6:])
+	elemSize := float32ByteLength
+	switch code {
+	case dtypeCodeFloat32:
+	case dtypeCodeFloat16:
+		elemSize = float16ByteLength
+	default:
+		return nil, false, fmt.Errorf("unsupported vector type code %d", code)
+	}
+
+	var fields [4]int
+	for i := range fields {
+		v := binary.LittleEndian.Uint64(data[16+8*i:])
+		if v > uint64(len(data)) {
+			return nil, false, fmt.Errorf("%w: header value %d exceeds the file size", errInvalidBinaryStore, v)
+		}
+		fields[i] = int(v)
+	}
+	dim := int(binary.LittleEndian.Uint32(data[8:]))
+	count, vectorOffset, metaOffset, metaLength := fields[0], fields[1], fields[2], fields[3]
+	if vectorOffset < binaryHeaderSize || metaOffset < vectorOffset || metaLength > len(data)-metaOffset {
+		return nil, false, fmt.Errorf("%w: blocks out of range", errInvalidBinaryStore)
+	}
+	if vectorSize := dim * elemSize; vectorSize > 0 && count > (metaOffset-vectorOffset)/vectorSize {
+		return nil, false, fmt.Errorf("%w: %d vectors of dimension %d overrun the vector block", errInvalidBinaryStore, count, dim)
+	}
+
+	var records []record
+	if err := json.Unmarshal(data[metaOffset:metaOffset+metaLength], &records); err != nil {
+		return nil, false, err
+	}
+	if len(records) != count {
+		return nil, false, errInvalidBinaryStore
+	}
+
+	block := data[vectorOffset : vectorOffset+count*dim*elemSize]
+	if vectors, ok := float32View(block, code); ok {
+		for i := range records {
+			records[i].Embedding = vectors[i*dim : (i+1)*dim : (i+1)*dim]
+		}
+		return records, count*dim > 0, nil
+	}
+
+	off := 0
+	for i := range records {
+		emb := make([]float32, dim)
+		for j := range emb {
+			if code == dtypeCodeFloat16 {
+				emb[j] = float16ToFloat32(binary.LittleEndian.Uint16(block[off:]))
+			} else {
+				emb[j] = math.Float32frombits(binary.LittleEndian.Uint32(block[off:]))
+			}
+			off += elemSize
+		}
+		records[i].Embedding = emb
+	}
+	return records, false, nil
+}
+
+func float32View(block []byte, code uint16) ([]float32, bool) {
+	if code != dtypeCodeFloat32 || !littleEndianHost || len(block) == 0 || uintptr(unsafe.Pointer(&block[0]))%float32ByteLength != 0 {
+		return nil, false
+	}
+	return unsafe.Slice((*float32)(unsafe.Pointer(&block[0])), len(block)/float32ByteLength), true
+}
+
+func (c binaryCodec) encodeEntry(e walEntry) ([]byte, error) {
+	metadata, err := json.Marshal(e.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	records, err := c.encode(e.Records)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	for _, field := range [][]byte{[]byte(e.Op), []byte(e.DocID), metadata} {
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(field)))
+		payload = append(payload, field...)
+	}
+	payload = append(payload, records...)
+
+	entry := make([]byte, binaryEntryHeaderSize, binaryEntryHeaderSize+len(payload))
+	entry[0] = binaryEntryMagic
+	binary.LittleEndian.PutUint32(entry[1:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(entry[5:], crc32.ChecksumIEEE(payload))
+	return append(entry, payload...), nil
+}
+
+// decodeEntry also reads the JSON lines of older logs.
+func (c binaryCodec) decodeEntry(data []byte) (walEntry, int, error) {
+	switch {
+	case data[0] == '{':
+		return jsonCodec{}.decodeEntry(data)
+	case data[0] != binaryEntryMagic:
+		if bytes.Count(data, []byte{0}) == len(data) {
+			return walEntry{}, 0, nil
+		}
+		return walEntry{}, 0, errInvalidLogRecord
+	case len(data) < binaryEntryHeaderSize:
+		return walEntry{}, 0, nil
+	}
+
+	length := int(binary.LittleEndian.Uint32(data[1:]))
+	if len(data)-binaryEntryHeaderSize < length {
+		return walEntry{}, 0, nil
+	}
+	payload := data[binaryEntryHeaderSize : binaryEntryHeaderSize+length]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[5:]) {
+		return walEntry{}, 0, fmt.Errorf("%w: checksum mismatch", errInvalidLogRecord)
+	}
+
+	var fields [3][]byte
+	for i := range fields {
+		if len(payload) < 4 || len(payload)-4 < int(binary.LittleEndian.Uint32(payload)) {
+			return walEntry{}, 0, errInvalidLogRecord
+		}
+		n := int(binary.LittleEndian.Uint32(payload))
+		fields[i], payload = payload[4:4+n], payload[4+n:]
+	}
+
+	e := walEntry{Op: string(fields[0]), DocID: string(fields[1])}
+	if err := json.Unmarshal(fields[2], &e.Metadata); err != nil {
+		return walEntry{}, 0, err
+	}
+	records, err := c.decode(payload)
+	if err != nil {
+		return walEntry{}, 0, err
+	}
+	if len(records) > 0 {
+		e.Records = records
+	}
+	return e, binaryEntryHeaderSize + length, nil
+}
+
+func dtypeOf(t VectorType) (uint16, int, error) {
+	switch t {
+	case VectorFloat32, "":
+		return dtypeCodeFloat32, float32ByteLength, nil
+	case VectorFloat16:
+		return dtypeCodeFloat16, float16ByteLength, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported vector type %q", t)
+	}
+}
+
+func alignUp(n int) int {
+	return (n + binaryBlockAlign - 1) / binaryBlockAlign * binaryBlockAlign
+}
+
+func float32ToFloat16(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int((bits>>23)&0xff) - 127 + 15
+	mant := bits & 0x7fffff
+
+	switch {
+	case (bits>>23)&0xff == 0xff:
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		return sign | 0x7c00
+	case exp <= 0:
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		half := uint16(mant >> shift)
+		if (mant>>(shift-1))&1 != 0 {
+			half++
+		}
+		return sign | half
+	default:
+		half := sign | uint16(exp)<<10 | uint16(mant>>13)
+		if mant&0x1000 != 0 {
+			half++
+		}
+		return half
+	}
+}
+
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		v := float32(math.Ldexp(float64(mant), -24))
+		if sign != 0 {
+			return -v
+		}
+		return v
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testRecords() []record {
+	return []record{
+		{DocID: "a", ChunkIndex: 0, Hash: "h", Text: "first", Embedding: []float32{0.5, -2, 1.25}, Metadata: map[string]string{"k": "v"}, CreatedAt: 1},
+		{DocID: "a", ChunkIndex: 1, Hash: "h", Text: "second", Embedding: []float32{0, 1, -0.125}, ParentText: "parent", Version: 2, Signature: []uint64{7}},
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	for _, vectorType := range []VectorType{VectorFloat32, VectorFloat16} {
+		codec := binaryCodec{vectorType: vectorType}
+		data, err := codec.encode(testRecords())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := codec.decode(data)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", vectorType, err)
+		}
+		if !reflect.DeepEqual(decoded, testRecords()) {
+			t.Errorf("%s: decode = %+v, want %+v", vectorType, decoded, testRecords())
+		}
+
+		path := filepath.Join(t.TempDir(), "store.bin")
+		if err := os.WriteFile(path, data, defaultFilePerm); err != nil {
+			t.Fatal(err)
+		}
+		loaded, release, err := codec.load(path)
+		if err != nil {
+			t.Fatalf("%s: load: %v", vectorType, err)
+		}
+		if !reflect.DeepEqual(loaded, testRecords()) {
+			t.Errorf("%s: load = %+v, want %+v", vectorType, loaded, testRecords())
+		}
+		if release != nil {
+			if err := release(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestBinaryRejectsCorruptHeaders(t *testing.T) {
+	for _, vectorType := range []VectorType{VectorFloat32, VectorFloat16} {
+		codec := binaryCodec{vectorType: vectorType}
+		valid, err := codec.encode(testRecords())
+		if err != nil {
+			t.Fatal(err)
+		}
+		with := func(offset int, v uint64) []byte {
+			data := append([]byte(nil), valid...)
+			binary.LittleEndian.PutUint64(data[offset:], v)
+			return data
+		}
+		withDim := func(dim uint32) []byte {
+			data := append([]byte(nil), valid...)
+			binary.LittleEndian.PutUint32(data[8:], dim)
+			return data
+		}
+
+		for name, data := range map[string][]byte{
+			"truncated header":      valid[:binaryHeaderSize-1],
+			"truncated meta":        valid[:len(valid)-1],
+			"magic":                 append([]byte("XXXX"), valid[4:]...),
+			"huge count":            with(16, 1<<62),
+			"negative count":        with(16, 1<<63),
+			"count overruns":        with(16, 1000),
+			"vector offset in head": with(24, 8),
+			"huge vector offset":    with(24, 1<<63),
+			"meta before vectors":   with(32, 0),
+			"huge meta offset":      with(32, 1<<62),
+			"huge meta length":      with(40, 1<<63),
+			"dimension overruns":    withDim(1 << 31),
+		} {
+			if _, err := codec.decode(data); !errors.Is(err, errInvalidBinaryStore) {
+				t.Errorf("%s: %s: decode = %v, want errInvalidBinaryStore", vectorType, name, err)
+			}
+		}
+	}
+}
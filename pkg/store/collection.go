@@ -0,0 +1,94 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const DefaultCollection = "default"
+
+var collectionNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,47}$`)
+
+type Collection struct {
+	Name           string    `json:"name"`
+	EmbeddingModel string    `json:"embedding_model"`
+	Dimension      int       `json:"dimension"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+func collectionName(name string) (string, error) {
+	if name == "" {
+		return DefaultCollection, nil
+	}
+	if !collectionNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid collection name %q: use lowercase letters, digits and underscores", name)
+	}
+	return name, nil
+}
+
+// checkEmbedding accepts anything while the collection has no model or dimension.
+func (c Collection) checkEmbedding(model string, dim int) error {
+	if c.EmbeddingModel != "" && model != "" && model != c.EmbeddingModel {
+		return fmt.Errorf("%w: collection %q uses model %q, got %q", ErrEmbeddingMismatch, c.Name, c.EmbeddingModel, model)
+	}
+	if c.Dimension > 0 && dim != c.Dimension {
+		return fmt.Errorf("%w: collection %q has dimension %d, got %d", ErrEmbeddingMismatch, c.Name, c.Dimension, dim)
+	}
+	return nil
+}
+
+// bindEmbedding reports whether c took on model or dim.
+func (c *Collection) bindEmbedding(model string, dim int) (bool, error) {
+	if err := c.checkEmbedding(model, dim); err != nil {
+		return false, err
+	}
+	changed := false
+	if c.EmbeddingModel == "" && model != "" {
+		c.EmbeddingModel = model
+		changed = true
+	}
+	if c.Dimension == 0 && dim > 0 {
+		c.Dimension = dim
+		changed = true
+	}
+	return changed, nil
+}
+
+func embeddingDimension(embeddings [][]float32) (int, error) {
+	if len(embeddings) == 0 {
+		return 0, nil
+	}
+	dim := len(embeddings[0])
+	for i, emb := range embeddings {
+		if len(emb) != dim || dim == 0 {
+			return 0, fmt.Errorf("%w: embedding %d has dimension %d, expected %d", ErrEmbeddingMismatch, i, len(emb), dim)
+		}
+	}
+	return dim, nil
+}
+
+func findCollection(collections []Collection, name string) (Collection, bool) {
+	i := slices.IndexFunc(collections, func(c Collection) bool {
+		return c.Name == name
+	})
+	if i < 0 {
+		return Collection{}, false
+	}
+	return collections[i], true
+}
+
+// withDefault adds the default collection, which older registries lack.
+func withDefault(collections []Collection) []Collection {
+	if _, ok := findCollection(collections, DefaultCollection); !ok {
+		collections = append(collections, Collection{Name: DefaultCollection})
+	}
+	slices.SortFunc(collections, func(a, b Collection) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return collections
+}
@@ -0,0 +1,285 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/tik-choco-lab/rag/pkg/content"
+)
+
+type DedupMethod string
+
+const (
+	DedupNone    DedupMethod = ""
+	DedupMinHash DedupMethod = "minhash"
+	DedupSimHash DedupMethod = "simhash"
+)
+
+type DedupAction string
+
+const (
+	// DedupSkip leaves the chunk out, so deleting the original removes the
+	// only copy of its text.
+	DedupSkip       DedupAction = "skip"
+	DedupLink       DedupAction = "link"
+	DedupDownweight DedupAction = "downweight"
+
+	shingleSize               = 5
+	minHashSize               = 64
+	minHashBandRows           = 4
+	simHashBandBits           = 8
+	defaultMinHashThreshold   = 0.8
+	defaultSimHashThreshold   = 0.9
+	defaultDuplicateWeight    = 0.5
+	duplicateSampleMultiplier = 3
+)
+
+type DedupOptions struct {
+	Method             DedupMethod
+	Threshold          float64
+	EmbeddingThreshold float32
+	Action             DedupAction
+	Weight             float32
+}
+
+// AddChunks keeps the links of chunks that arrive signed.
+type DuplicateLinker interface {
+	LinkDuplicates(ctx context.Context, collection string, docID string, chunks []Chunk, options DedupOptions) error
+}
+
+// The zero ChunkRef names no chunk.
+type ChunkRef struct {
+	DocID string
+	Index int
+}
+
+type dedupCandidate struct {
+	ref         ChunkRef
+	signature   []uint64
+	duplicateOf ChunkRef
+}
+
+// Linking to the original rather than to another duplicate keeps every
+// copy in one group.
+func (c dedupCandidate) original() ChunkRef {
+	if c.duplicateOf.DocID != "" {
+		return c.duplicateOf
+	}
+	return c.ref
+}
+
+type duplicateSource struct {
+	signatures func(ctx context.Context, bands []uint64) ([]dedupCandidate, error)
+	nearest    func(ctx context.Context, embedding []float32) (ChunkRef, float32, error)
+}
+
+func (o DedupOptions) validate() error {
+	switch o.Method {
+	case DedupNone, DedupMinHash, DedupSimHash:
+	default:
+		return fmt.Errorf("unsupported dedup method %q", o.Method)
+	}
+	switch o.Action {
+	case "", DedupSkip, DedupLink, DedupDownweight:
+	default:
+		return fmt.Errorf("unsupported dedup action %q", o.Action)
+	}
+	return nil
+}
+
+func (o DedupOptions) threshold() float64 {
+	switch {
+	case o.Threshold > 0:
+		return o.Threshold
+	case o.Method == DedupSimHash:
+		return defaultSimHashThreshold
+	}
+	return defaultMinHashThreshold
+}
+
+func (o DedupOptions) weight() float32 {
+	if o.Weight > 0 {
+		return o.Weight
+	}
+	return defaultDuplicateWeight
+}
+
+func (o DedupOptions) signature(text string) []uint64 {
+	shingles := content.Shingles(text, shingleSize)
+	switch o.Method {
+	case DedupMinHash:
+		return content.MinHash(shingles, minHashSize)
+	case DedupSimHash:
+		return []uint64{content.SimHash(shingles)}
+	}
+	return nil
+}
+
+func (o DedupOptions) similarity(a, b []uint64) float64 {
+	switch {
+	case len(a) != len(b):
+		return 0
+	case o.Method == DedupSimHash && len(a) == 1:
+		return content.SimHashSimilarity(a[0], b[0])
+	case o.Method == DedupMinHash:
+		return content.MinHashSimilarity(a, b)
+	}
+	return 0
+}
+
+// signatureBands splits a signature into locality-sensitive hashing bands, so
+// only chunks agreeing on a whole band are compared. The band number is mixed
+// into each key. The Postgres migration computes the same keys in SQL.
+func signatureBands(signature []uint64) []uint64 {
+	var bands []uint64
+	switch {
+	case len(signature) == 1:
+		for i := range uint64(64 / simHashBandBits) {
+			bands = append(bands, signature[0]>>(i*simHashBandBits)&(1<<simHashBandBits-1)|i<<simHashBandBits)
+		}
+	case len(signature)%minHashBandRows == 0:
+		for i := 0; i < len(signature); i += minHashBandRows {
+			key := uint64(i / minHashBandRows)
+			for _, h := range signature[i : i+minHashBandRows] {
+				key ^= h
+			}
+			bands = append(bands, key)
+		}
+	}
+	return bands
+}
+
+func nearDuplicates(chunks []Chunk, candidates []dedupCandidate, dedup DedupOptions) {
+	index := make(map[uint64][]int)
+	for j, c := range candidates {
+		for _, b := range signatureBands(c.signature) {
+			index[b] = append(index[b], j)
+		}
+	}
+	for i := range chunks {
+		var matches []int
+		for _, b := range signatureBands(chunks[i].Signature) {
+			matches = append(matches, index[b]...)
+		}
+		slices.Sort(matches)
+		best := dedup.threshold()
+		for _, j := range slices.Compact(matches) {
+			if sim := dedup.similarity(chunks[i].Signature, candidates[j].signature); sim >= best {
+				best = sim
+				chunks[i].DuplicateOf = candidates[j].original()
+			}
+		}
+	}
+}
+
+func linkDuplicates(ctx context.Context, chunks []Chunk, dedup DedupOptions, source duplicateSource) error {
+	bands := make(map[uint64]bool)
+	for i := range chunks {
+		chunks[i].Signature = dedup.signature(chunks[i].Text)
+		for _, b := range signatureBands(chunks[i].Signature) {
+			bands[b] = true
+		}
+	}
+	candidates, err := source.signatures(ctx, slices.Collect(maps.Keys(bands)))
+	if err != nil {
+		return err
+	}
+	nearDuplicates(chunks, candidates, dedup)
+	return nil
+}
+
+// Chunks a DuplicateLinker already signed keep the links it made.
+func embedDocument(ctx context.Context, chunks []Chunk, previous []Chunk, options AddOptions, source duplicateSource, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) ([]Chunk, AddResult, error) {
+	dedup := options.Dedup
+	if err := dedup.validate(); err != nil {
+		return nil, AddResult{}, err
+	}
+
+	signed := slices.ContainsFunc(chunks, func(c Chunk) bool {
+		return c.Signature != nil
+	})
+	if dedup.Method != DedupNone && !signed {
+		if err := linkDuplicates(ctx, chunks, dedup, source); err != nil {
+			return nil, AddResult{}, err
+		}
+	}
+
+	var skipped int
+	if dedup.Action == DedupSkip {
+		chunks, skipped = dropDuplicates(chunks)
+	}
+	missing, reused, result := reuseEmbeddings(chunks, previous)
+	if err := embedChunks(ctx, chunks, missing, embeddingsFunc); err != nil {
+		return nil, AddResult{}, err
+	}
+
+	if dedup.EmbeddingThreshold > 0 {
+		kept := chunks[:0]
+		for i, c := range chunks {
+			if c.DuplicateOf.DocID == "" {
+				ref, score, err := source.nearest(ctx, content.Normalize(c.Embedding))
+				if err != nil {
+					return nil, AddResult{}, err
+				}
+				if ref.DocID != "" && score >= dedup.EmbeddingThreshold {
+					c.DuplicateOf = ref
+				}
+			}
+			if c.DuplicateOf.DocID == "" || dedup.Action != DedupSkip {
+				kept = append(kept, c)
+				continue
+			}
+			skipped++
+			if reused[i] {
+				result.Kept--
+				result.Removed++
+			} else {
+				result.Added--
+			}
+		}
+		chunks = kept
+	}
+
+	result.Duplicates = skipped
+	for i, c := range chunks {
+		if c.DuplicateOf.DocID == "" {
+			continue
+		}
+		result.Duplicates++
+		if dedup.Action == DedupDownweight {
+			chunks[i].Weight = dedup.weight()
+		}
+	}
+	return chunks, result, nil
+}
+
+// dropDuplicates removes linked chunks, moving their parent text to a sibling.
+func dropDuplicates(chunks []Chunk) ([]Chunk, int) {
+	parents := parentTexts(chunks)
+	kept := chunks[:0]
+	for _, c := range chunks {
+		if c.DuplicateOf.DocID == "" {
+			kept = append(kept, c)
+		}
+	}
+	return shareParents(kept, parents), len(chunks) - len(kept)
+}
+
+func collapseDuplicates(hits []hit) []hit {
+	seen := make(map[ChunkRef]bool)
+	var collapsed []hit
+	for _, h := range hits {
+		group := h.duplicateOf
+		if group.DocID == "" {
+			group = ChunkRef{DocID: h.result.DocID, Index: h.result.ChunkIndex}
+		}
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		collapsed = append(collapsed, h)
+	}
+	return collapsed
+}
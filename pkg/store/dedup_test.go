@@ -0,0 +1,58 @@
+package store
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNearDuplicatesBanding(t *testing.T) {
+	base := strings.Repeat("the quick brown fox jumps over the lazy dog while the cat sleeps on the warm mat ", 4)
+	stored := []string{
+		base,
+		strings.Repeat("an entirely different passage about databases, indexes and query planning ", 4),
+	}
+
+	for _, method := range []DedupMethod{DedupMinHash, DedupSimHash} {
+		dedup := DedupOptions{Method: method}
+		candidates := make([]dedupCandidate, len(stored))
+		for i, text := range stored {
+			candidates[i] = dedupCandidate{ref: ChunkRef{DocID: "stored", Index: i}, signature: dedup.signature(text)}
+		}
+		candidates = append(candidates, dedupCandidate{ref: ChunkRef{DocID: "copy", Index: 0}, signature: dedup.signature(base), duplicateOf: ChunkRef{DocID: "stored", Index: 0}})
+
+		chunks := []Chunk{
+			{Text: base + "and then it rains"},
+			{Text: "nothing like the stored chunks at all, just a short unrelated remark"},
+		}
+		for i := range chunks {
+			chunks[i].Signature = dedup.signature(chunks[i].Text)
+		}
+		nearDuplicates(chunks, candidates, dedup)
+
+		if want := (ChunkRef{DocID: "stored", Index: 0}); chunks[0].DuplicateOf != want {
+			t.Errorf("%s: near duplicate linked to %+v, want %+v", method, chunks[0].DuplicateOf, want)
+		}
+		if chunks[1].DuplicateOf.DocID != "" {
+			t.Errorf("%s: unrelated chunk linked to %+v", method, chunks[1].DuplicateOf)
+		}
+	}
+}
+
+func TestSignatureBands(t *testing.T) {
+	tests := []struct {
+		name      string
+		signature []uint64
+		want      []uint64
+	}{
+		{"none", nil, nil},
+		{"simhash", []uint64{0x0807060504030201}, []uint64{0x001, 0x102, 0x203, 0x304, 0x405, 0x506, 0x607, 0x708}},
+		{"minhash", []uint64{1, 2, 4, 8, 16, 32, 64, 128}, []uint64{15, 1 ^ 240}},
+		{"uneven", []uint64{1, 2, 3}, nil},
+	}
+	for _, tt := range tests {
+		if got := signatureBands(tt.signature); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: signatureBands = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// expiresAt returns the zero time for a document that never expires.
+func (o AddOptions) expiresAt(c Collection, now time.Time) time.Time {
+	if !o.ExpiresAt.IsZero() || c.TTL <= 0 {
+		return o.ExpiresAt
+	}
+	return now.Add(c.TTL).In(jst)
+}
+
+func PurgeEvery(ctx context.Context, s Store, collection string, interval time.Duration, report func(purged int, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.Purge(ctx, collection)
+			if report != nil {
+				report(n, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+type ExportFormat string
+
+const (
+	ExportJSONL    ExportFormat = "jsonl"
+	ExportColumnar ExportFormat = "columnar"
+
+	exportVersion          = 1
+	defaultExportBatchSize = 100
+)
+
+type ExportHeader struct {
+	Version        int           `json:"version"`
+	Collection     string        `json:"collection"`
+	EmbeddingModel string        `json:"embedding_model"`
+	Dimension      int           `json:"dimension"`
+	TTL            time.Duration `json:"ttl,omitempty"`
+	ExportedAt     time.Time     `json:"exported_at"`
+}
+
+type ExportOptions struct {
+	Format    ExportFormat
+	BatchSize int
+}
+
+type exportWriter interface {
+	writeHeader(h ExportHeader) error
+	writeDocuments(docs []Document) error
+	close() error
+}
+
+type exportReader interface {
+	readHeader() (ExportHeader, error)
+	// next returns io.EOF after the last batch.
+	next() ([]Document, error)
+}
+
+// Archived versions are not exported.
+func Export(ctx context.Context, s Store, collection string, w io.Writer, options ExportOptions) (int, error) {
+	name, err := collectionName(collection)
+	if err != nil {
+		return 0, err
+	}
+	collections, err := s.ListCollections(ctx)
+	if err != nil {
+		return 0, err
+	}
+	info, ok := findCollection(collections, name)
+	if !ok {
+		return 0, ErrCollectionNotFound
+	}
+
+	var ew exportWriter
+	switch options.Format {
+	case ExportJSONL, "":
+		ew = newJSONLWriter(w)
+	case ExportColumnar:
+		ew = newColumnarWriter(w)
+	default:
+		return 0, fmt.Errorf("unsupported export format %q", options.Format)
+	}
+
+	header := ExportHeader{
+		Version:        exportVersion,
+		Collection:     info.Name,
+		EmbeddingModel: info.EmbeddingModel,
+		Dimension:      info.Dimension,
+		TTL:            info.TTL,
+		ExportedAt:     time.Now().In(jst),
+	}
+	if err := ew.writeHeader(header); err != nil {
+		return 0, err
+	}
+
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultExportBatchSize
+	}
+	exported := 0
+	for offset := 0; ; offset += batchSize {
+		infos, err := s.ListDocuments(ctx, name, ListOptions{Offset: offset, Limit: batchSize})
+		if err != nil {
+			return exported, err
+		}
+		if len(infos) == 0 {
+			break
+		}
+
+		docs := make([]Document, 0, len(infos))
+		for _, di := range infos {
+			doc, err := s.GetDocument(ctx, name, di.DocID)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return exported, err
+			}
+			docs = append(docs, *doc)
+		}
+		if err := ew.writeDocuments(docs); err != nil {
+			return exported, err
+		}
+		exported += len(docs)
+	}
+	return exported, ew.close()
+}
+
+// An empty collection imports into the one named in the header.
+func Import(ctx context.Context, s Store, collection string, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	var er exportReader
+	if magic, err := br.Peek(len(columnarMagic)); err == nil && string(magic) == columnarMagic {
+		er = newColumnarReader(br)
+	} else {
+		er = newJSONLReader(br)
+	}
+
+	header, err := er.readHeader()
+	if err != nil {
+		return 0, fmt.Errorf("read export header: %w", err)
+	}
+	if header.Version != exportVersion {
+		return 0, fmt.Errorf("unsupported export version %d", header.Version)
+	}
+	if collection == "" {
+		collection = header.Collection
+	}
+	name, err := collectionName(collection)
+	if err != nil {
+		return 0, err
+	}
+	if err := prepareImport(ctx, s, name, header); err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for {
+		docs, err := er.next()
+		if errors.Is(err, io.EOF) {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		for _, doc := range docs {
+			for _, c := range doc.Chunks {
+				if header.Dimension > 0 && len(c.Embedding) != header.Dimension {
+					return imported, fmt.Errorf("%w: chunk %d of %q has dimension %d, header says %d", ErrEmbeddingMismatch, c.Index, doc.DocID, len(c.Embedding), header.Dimension)
+				}
+			}
+			if doc.Date == "" {
+				doc.Date = doc.CreatedAt.In(jst).Format(time.RFC3339)
+			}
+			if err := s.PutDocument(ctx, name, doc); err != nil {
+				return imported, fmt.Errorf("import %q: %w", doc.DocID, err)
+			}
+			imported++
+		}
+	}
+}
+
+func prepareImport(ctx context.Context, s Store, name string, header ExportHeader) error {
+	err := s.CreateCollection(ctx, Collection{
+		Name:           name,
+		EmbeddingModel: header.EmbeddingModel,
+		Dimension:      header.Dimension,
+		TTL:            header.TTL,
+	})
+	if !errors.Is(err, ErrCollectionExists) {
+		return err
+	}
+
+	collections, err := s.ListCollections(ctx)
+	if err != nil {
+		return err
+	}
+	existing, _ := findCollection(collections, name)
+	dim := header.Dimension
+	if dim == 0 {
+		dim = existing.Dimension
+	}
+	return existing.checkEmbedding(header.EmbeddingModel, dim)
+}
@@ -0,0 +1,471 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	columnarMagic = "RAGC"
+
+	// Lengths read from a file are checked against these before anything is
+	// allocated for them. The writer keeps to them as well.
+	maxColumnarHeaderLength  = 1 << 20
+	maxColumnarColumnsLength = 1 << 28
+	maxColumnarVectorsLength = 1 << 30
+)
+
+var errInvalidExport = errors.New("invalid columnar export")
+
+// columnarWriter stores documents in row groups, much like Parquet. A group
+// holds one column per field, with an entry per document for the document
+// columns and per chunk for the chunk columns, followed by the embeddings of
+// all its chunks as one dense block of little-endian float32. Integers are
+// varints, times Unix nanoseconds with 0 for none, strings and lists a
+// uvarint length and their elements, and weights float32 bits.
+//
+//	file:  magic[4] headerLength:u32 header(JSON)
+//	group: documents:u32 chunks:u32 dim:u32 columnsLength:u32 columns vectors
+//	end:   documents:u32 = 0
+type columnarWriter struct {
+	w *bufio.Writer
+}
+
+type columnGroup struct {
+	DocID      []string
+	Version    []int
+	Hash       []string
+	Metadata   []map[string]string
+	CreatedAt  []time.Time
+	ExpiresAt  []time.Time
+	ChunkCount []int
+
+	ChunkIndex  []int
+	ChunkHash   []string
+	Text        []string
+	ParentIndex []int
+	ParentText  []string
+
+	Signature      [][]uint64
+	DuplicateOf    []string
+	DuplicateIndex []int
+	Weight         []float32
+}
+
+func newColumnarWriter(w io.Writer) *columnarWriter {
+	return &columnarWriter{w: bufio.NewWriter(w)}
+}
+
+func (w *columnarWriter) writeHeader(h ExportHeader) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	buf := binary.LittleEndian.AppendUint32([]byte(columnarMagic), uint32(len(data)))
+	_, err = w.w.Write(append(buf, data...))
+	return err
+}
+
+func (w *columnarWriter) writeDocuments(docs []Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	var cols columnGroup
+	var vectors []float32
+	dim := -1
+	for _, doc := range docs {
+		cols.DocID = append(cols.DocID, doc.DocID)
+		cols.Version = append(cols.Version, doc.Version)
+		cols.Hash = append(cols.Hash, doc.Hash)
+		cols.Metadata = append(cols.Metadata, doc.Metadata)
+		cols.CreatedAt = append(cols.CreatedAt, doc.CreatedAt)
+		cols.ExpiresAt = append(cols.ExpiresAt, doc.ExpiresAt)
+		cols.ChunkCount = append(cols.ChunkCount, len(doc.Chunks))
+		for _, c := range doc.Chunks {
+			if dim < 0 {
+				dim = len(c.Embedding)
+			}
+			if len(c.Embedding) != dim {
+				return fmt.Errorf("%w: chunk %d of %q has dimension %d, expected %d", ErrEmbeddingMismatch, c.Index, doc.DocID, len(c.Embedding), dim)
+			}
+			cols.ChunkIndex = append(cols.ChunkIndex, c.Index)
+			cols.ChunkHash = append(cols.ChunkHash, c.Hash)
+			cols.Text = append(cols.Text, c.Text)
+			cols.ParentIndex = append(cols.ParentIndex, c.ParentIndex)
+			cols.ParentText = append(cols.ParentText, c.ParentText)
+			cols.Signature = append(cols.Signature, c.Signature)
+			cols.DuplicateOf = append(cols.DuplicateOf, c.DuplicateOf.DocID)
+			cols.DuplicateIndex = append(cols.DuplicateIndex, c.DuplicateOf.Index)
+			cols.Weight = append(cols.Weight, c.Weight)
+			vectors = append(vectors, c.Embedding...)
+		}
+	}
+	dim = max(dim, 0)
+
+	data := cols.encode()
+	if len(data) > maxColumnarColumnsLength || len(vectors)*float32ByteLength > maxColumnarVectorsLength {
+		return fmt.Errorf("row group of %d documents from %q exceeds the columnar size limits: lower the batch size", len(docs), docs[0].DocID)
+	}
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(docs)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(cols.Text)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(dim))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+	buf = append(buf, data...)
+	for _, v := range vectors {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(v))
+	}
+	_, err := w.w.Write(buf)
+	return err
+}
+
+func (w *columnarWriter) close() error {
+	if _, err := w.w.Write(binary.LittleEndian.AppendUint32(nil, 0)); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+type columnarReader struct {
+	r io.Reader
+}
+
+func newColumnarReader(r io.Reader) *columnarReader {
+	return &columnarReader{r: r}
+}
+
+func (r *columnarReader) readHeader() (ExportHeader, error) {
+	var h ExportHeader
+	buf := make([]byte, len(columnarMagic)+4)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return h, err
+	}
+	if string(buf[:len(columnarMagic)]) != columnarMagic {
+		return h, errInvalidExport
+	}
+	length := binary.LittleEndian.Uint32(buf[len(columnarMagic):])
+	if length > maxColumnarHeaderLength {
+		return h, fmt.Errorf("%w: header of %d bytes", errInvalidExport, length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return h, err
+	}
+	err := json.Unmarshal(data, &h)
+	return h, err
+}
+
+func (r *columnarReader) next() ([]Document, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, errorsUnexpected(err)
+	}
+	docCount := int(binary.LittleEndian.Uint32(buf))
+	if docCount == 0 {
+		return nil, io.EOF
+	}
+
+	buf = make([]byte, 12)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, errorsUnexpected(err)
+	}
+	chunkCount := int(binary.LittleEndian.Uint32(buf))
+	dim := int(binary.LittleEndian.Uint32(buf[4:]))
+	length := int(binary.LittleEndian.Uint32(buf[8:]))
+	if length > maxColumnarColumnsLength {
+		return nil, fmt.Errorf("%w: columns of %d bytes", errInvalidExport, length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, errorsUnexpected(err)
+	}
+	cols, err := decodeColumns(data, docCount, chunkCount)
+	if err != nil {
+		return nil, err
+	}
+
+	// The columns hold at least a byte per chunk, so chunkCount is bounded
+	// by their length and the product cannot overflow.
+	if dim > maxColumnarVectorsLength/float32ByteLength || chunkCount*dim*float32ByteLength > maxColumnarVectorsLength {
+		return nil, fmt.Errorf("%w: %d vectors of dimension %d", errInvalidExport, chunkCount, dim)
+	}
+	vectors := make([]byte, chunkCount*dim*float32ByteLength)
+	if _, err := io.ReadFull(r.r, vectors); err != nil {
+		return nil, errorsUnexpected(err)
+	}
+
+	docs := make([]Document, docCount)
+	chunk := 0
+	for i := range docs {
+		docs[i] = Document{
+			DocumentInfo: DocumentInfo{
+				DocID:      cols.DocID[i],
+				Version:    cols.Version[i],
+				Hash:       cols.Hash[i],
+				Metadata:   cols.Metadata[i],
+				ChunkCount: cols.ChunkCount[i],
+				CreatedAt:  cols.CreatedAt[i],
+				ExpiresAt:  cols.ExpiresAt[i],
+			},
+			Chunks: make([]Chunk, cols.ChunkCount[i]),
+		}
+		for j := range docs[i].Chunks {
+			emb := make([]float32, dim)
+			for k := range emb {
+				off := (chunk*dim + k) * float32ByteLength
+				emb[k] = math.Float32frombits(binary.LittleEndian.Uint32(vectors[off:]))
+			}
+			docs[i].Chunks[j] = Chunk{
+				Index:       cols.ChunkIndex[chunk],
+				Hash:        cols.ChunkHash[chunk],
+				Text:        cols.Text[chunk],
+				ParentIndex: cols.ParentIndex[chunk],
+				ParentText:  cols.ParentText[chunk],
+				Embedding:   emb,
+				Signature:   cols.Signature[chunk],
+				DuplicateOf: ChunkRef{DocID: cols.DuplicateOf[chunk], Index: cols.DuplicateIndex[chunk]},
+				Weight:      cols.Weight[chunk],
+			}
+			chunk++
+		}
+	}
+	return docs, nil
+}
+
+func (c columnGroup) encode() []byte {
+	var buf []byte
+	buf = appendColumn(buf, c.DocID, appendString)
+	buf = appendColumn(buf, c.Version, appendInt)
+	buf = appendColumn(buf, c.Hash, appendString)
+	buf = appendColumn(buf, c.Metadata, appendMetadata)
+	buf = appendColumn(buf, c.CreatedAt, appendTime)
+	buf = appendColumn(buf, c.ExpiresAt, appendTime)
+	buf = appendColumn(buf, c.ChunkCount, appendInt)
+
+	buf = appendColumn(buf, c.ChunkIndex, appendInt)
+	buf = appendColumn(buf, c.ChunkHash, appendString)
+	buf = appendColumn(buf, c.Text, appendString)
+	buf = appendColumn(buf, c.ParentIndex, appendInt)
+	buf = appendColumn(buf, c.ParentText, appendString)
+
+	buf = appendColumn(buf, c.Signature, appendSignature)
+	buf = appendColumn(buf, c.DuplicateOf, appendString)
+	buf = appendColumn(buf, c.DuplicateIndex, appendInt)
+	return appendColumn(buf, c.Weight, appendWeight)
+}
+
+func decodeColumns(data []byte, docs, chunks int) (columnGroup, error) {
+	r := &columnReader{data: data}
+	c := columnGroup{
+		DocID:      readColumn(r, docs, r.string),
+		Version:    readColumn(r, docs, r.int),
+		Hash:       readColumn(r, docs, r.string),
+		Metadata:   readColumn(r, docs, r.metadata),
+		CreatedAt:  readColumn(r, docs, r.time),
+		ExpiresAt:  readColumn(r, docs, r.time),
+		ChunkCount: readColumn(r, docs, r.int),
+
+		ChunkIndex:  readColumn(r, chunks, r.int),
+		ChunkHash:   readColumn(r, chunks, r.string),
+		Text:        readColumn(r, chunks, r.string),
+		ParentIndex: readColumn(r, chunks, r.int),
+		ParentText:  readColumn(r, chunks, r.string),
+
+		Signature:      readColumn(r, chunks, r.signature),
+		DuplicateOf:    readColumn(r, chunks, r.string),
+		DuplicateIndex: readColumn(r, chunks, r.int),
+		Weight:         readColumn(r, chunks, r.weight),
+	}
+	if r.err != nil {
+		return columnGroup{}, r.err
+	}
+	if len(r.data) > 0 || !c.valid(chunks) {
+		return columnGroup{}, errInvalidExport
+	}
+	return c, nil
+}
+
+func (c columnGroup) valid(chunks int) bool {
+	total := 0
+	for _, n := range c.ChunkCount {
+		if n < 0 {
+			return false
+		}
+		total += n
+	}
+	return total == chunks
+}
+
+func appendColumn[T any](buf []byte, col []T, put func([]byte, T) []byte) []byte {
+	for _, v := range col {
+		buf = put(buf, v)
+	}
+	return buf
+}
+
+func appendInt(buf []byte, v int) []byte {
+	return binary.AppendVarint(buf, int64(v))
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(binary.AppendUvarint(buf, uint64(len(s))), s...)
+}
+
+func appendTime(buf []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return binary.AppendVarint(buf, 0)
+	}
+	return binary.AppendVarint(buf, t.UnixNano())
+}
+
+func appendMetadata(buf []byte, m map[string]string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(m)))
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		buf = appendString(appendString(buf, k), m[k])
+	}
+	return buf
+}
+
+func appendSignature(buf []byte, sig []uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(sig)))
+	for _, v := range sig {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	return buf
+}
+
+func appendWeight(buf []byte, w float32) []byte {
+	return binary.LittleEndian.AppendUint32(buf, math.Float32bits(w))
+}
+
+// The first value that runs past the data fails the reader; later reads
+// return zero.
+type columnReader struct {
+	data []byte
+	err  error
+}
+
+// readColumn reads n values. Every value takes at least a byte, so a count
+// beyond the remaining data fails before anything is allocated for it.
+func readColumn[T any](r *columnReader, n int, read func() T) []T {
+	if r.err == nil && n > len(r.data) {
+		r.err = errInvalidExport
+	}
+	if r.err != nil {
+		return nil
+	}
+	col := make([]T, n)
+	for i := range col {
+		col[i] = read()
+	}
+	return col
+}
+
+func (r *columnReader) take(n uint64) []byte {
+	if r.err == nil && n > uint64(len(r.data)) {
+		r.err = errInvalidExport
+	}
+	if r.err != nil {
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *columnReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errInvalidExport
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *columnReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errInvalidExport
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *columnReader) int() int {
+	return int(r.varint())
+}
+
+func (r *columnReader) string() string {
+	return string(r.take(r.uvarint()))
+}
+
+func (r *columnReader) time() time.Time {
+	n := r.varint()
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).In(jst)
+}
+
+func (r *columnReader) metadata() map[string]string {
+	n := r.uvarint()
+	if n == 0 || r.err != nil {
+		return nil
+	}
+	m := make(map[string]string)
+	for range n {
+		k := r.string()
+		m[k] = r.string()
+		if r.err != nil {
+			return nil
+		}
+	}
+	return m
+}
+
+func (r *columnReader) signature() []uint64 {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.data))/8 {
+		r.err = errInvalidExport
+	}
+	if n == 0 || r.err != nil {
+		return nil
+	}
+	data := r.take(n * 8)
+	sig := make([]uint64, n)
+	for i := range sig {
+		sig[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	return sig
+}
+
+func (r *columnReader) weight() float32 {
+	data := r.take(4)
+	if r.err != nil {
+		return 0
+	}
+	return math.Float32frombits(binary.LittleEndian.Uint32(data))
+}
+
+func errorsUnexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testColumnarDocuments() []Document {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 6, jst)
+	return []Document{
+		{
+			DocumentInfo: DocumentInfo{
+				DocID:      "a",
+				Version:    3,
+				Hash:       "h1",
+				Metadata:   map[string]string{"lang": "ja", "quote'": `"`},
+				ChunkCount: 2,
+				CreatedAt:  created,
+				ExpiresAt:  created.Add(time.Hour),
+			},
+			Chunks: []Chunk{
+				{Index: 0, Hash: "c0", Text: "first", ParentText: "parent", Embedding: []float32{1, 0}, Signature: []uint64{1, 1 << 63}, Weight: 0.5},
+				{Index: 1, Hash: "c1", Text: "second", Embedding: []float32{0, -1}, DuplicateOf: ChunkRef{DocID: "b", Index: 4}},
+			},
+		},
+		{
+			DocumentInfo: DocumentInfo{DocID: "b", Hash: "h2", CreatedAt: created},
+		},
+	}
+}
+
+func TestColumnarRoundTrip(t *testing.T) {
+	docs := testColumnarDocuments()
+	var buf bytes.Buffer
+	w := newColumnarWriter(&buf)
+	if err := w.writeHeader(ExportHeader{Version: exportVersion, Collection: "c", Dimension: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.writeDocuments(docs); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newColumnarReader(&buf)
+	if h, err := r.readHeader(); err != nil || h.Collection != "c" {
+		t.Fatalf("readHeader = %+v, %v", h, err)
+	}
+	got, err := r.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs[1].Chunks = []Chunk{}
+	for i := range got {
+		if !got[i].CreatedAt.Equal(docs[i].CreatedAt) || !got[i].ExpiresAt.Equal(docs[i].ExpiresAt) {
+			t.Errorf("document %d has times %v, %v, want %v, %v", i, got[i].CreatedAt, got[i].ExpiresAt, docs[i].CreatedAt, docs[i].ExpiresAt)
+		}
+		got[i].CreatedAt, got[i].ExpiresAt = docs[i].CreatedAt, docs[i].ExpiresAt
+	}
+	if !reflect.DeepEqual(got, docs) {
+		t.Errorf("read\n%+v\nwant\n%+v", got, docs)
+	}
+	if _, err := r.next(); !errors.Is(err, io.EOF) {
+		t.Errorf("after the last group: %v, want io.EOF", err)
+	}
+}
+
+func TestColumnarRejectsOversizedLengths(t *testing.T) {
+	header := binary.LittleEndian.AppendUint32([]byte(columnarMagic), maxColumnarHeaderLength+1)
+	if _, err := newColumnarReader(bytes.NewReader(header)).readHeader(); !errors.Is(err, errInvalidExport) {
+		t.Errorf("header of %d bytes: %v, want errInvalidExport", maxColumnarHeaderLength+1, err)
+	}
+
+	group := func(docs, chunks, dim, length uint32, columns []byte) io.Reader {
+		var buf []byte
+		for _, v := range []uint32{docs, chunks, dim, length} {
+			buf = binary.LittleEndian.AppendUint32(buf, v)
+		}
+		return bytes.NewReader(append(buf, columns...))
+	}
+	var one columnGroup
+	one.DocID = []string{"a"}
+	one.Version = []int{1}
+	one.Hash = []string{""}
+	one.Metadata = []map[string]string{nil}
+	one.CreatedAt = []time.Time{{}}
+	one.ExpiresAt = []time.Time{{}}
+	one.ChunkCount = []int{0}
+	valid := one.encode()
+	huge := binary.AppendUvarint(nil, 1<<40)
+
+	for name, r := range map[string]io.Reader{
+		"columns":        group(1, 0, 0, 0xffffffff, nil),
+		"documents":      group(0xffffffff, 0, 0, uint32(len(valid)), valid),
+		"chunks":         group(1, 0xffffffff, 0, uint32(len(valid)), valid),
+		"dimension":      group(1, 0, 0xffffffff, uint32(len(valid)), valid),
+		"string length":  group(1, 0, 0, uint32(len(huge)), huge),
+		"trailing bytes": group(1, 0, 0, uint32(len(valid)+1), append(valid, 0)),
+	} {
+		if _, err := newColumnarReader(r).next(); !errors.Is(err, errInvalidExport) {
+			t.Errorf("%s: %v, want errInvalidExport", name, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// The header takes the first line.
+type exportDocument struct {
+	DocID     string            `json:"doc_id"`
+	Version   int               `json:"version,omitempty"`
+	Hash      string            `json:"hash"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Chunks    []exportChunk     `json:"chunks"`
+}
+
+type exportChunk struct {
+	Index       int       `json:"index"`
+	Hash        string    `json:"hash,omitempty"`
+	Text        string    `json:"text"`
+	ParentIndex int       `json:"parent_index,omitempty"`
+	ParentText  string    `json:"parent_text,omitempty"`
+	Embedding   []float32 `json:"embedding"`
+
+	Signature      []uint64 `json:"signature,omitempty"`
+	DuplicateOf    string   `json:"duplicate_of,omitempty"`
+	DuplicateIndex int      `json:"duplicate_index,omitempty"`
+	Weight         float32  `json:"weight,omitempty"`
+}
+
+func exportDocumentOf(doc Document) exportDocument {
+	d := exportDocument{
+		DocID:     doc.DocID,
+		Version:   doc.Version,
+		Hash:      doc.Hash,
+		Metadata:  doc.Metadata,
+		CreatedAt: doc.CreatedAt,
+		ExpiresAt: timePtr(doc.ExpiresAt),
+		Chunks:    make([]exportChunk, len(doc.Chunks)),
+	}
+	for i, c := range doc.Chunks {
+		d.Chunks[i] = exportChunk{
+			Index:       c.Index,
+			Hash:        c.Hash,
+			Text:        c.Text,
+			ParentIndex: c.ParentIndex,
+			ParentText:  c.ParentText,
+			Embedding:   c.Embedding,
+
+			Signature:      c.Signature,
+			DuplicateOf:    c.DuplicateOf.DocID,
+			DuplicateIndex: c.DuplicateOf.Index,
+			Weight:         c.Weight,
+		}
+	}
+	return d
+}
+
+func (d exportDocument) document() Document {
+	doc := Document{
+		DocumentInfo: DocumentInfo{
+			DocID:      d.DocID,
+			Version:    d.Version,
+			Hash:       d.Hash,
+			Metadata:   d.Metadata,
+			ChunkCount: len(d.Chunks),
+			CreatedAt:  d.CreatedAt,
+			ExpiresAt:  timeOf(d.ExpiresAt),
+		},
+		Chunks: make([]Chunk, len(d.Chunks)),
+	}
+	for i, c := range d.Chunks {
+		doc.Chunks[i] = Chunk{
+			Index:       c.Index,
+			Hash:        c.Hash,
+			Text:        c.Text,
+			ParentIndex: c.ParentIndex,
+			ParentText:  c.ParentText,
+			Embedding:   c.Embedding,
+			Signature:   c.Signature,
+			DuplicateOf: ChunkRef{DocID: c.DuplicateOf, Index: c.DuplicateIndex},
+			Weight:      c.Weight,
+		}
+	}
+	return doc
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func timeOf(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONLWriter(w io.Writer) *jsonlWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonlWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (w *jsonlWriter) writeHeader(h ExportHeader) error {
+	return w.enc.Encode(h)
+}
+
+func (w *jsonlWriter) writeDocuments(docs []Document) error {
+	for _, doc := range docs {
+		if err := w.enc.Encode(exportDocumentOf(doc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *jsonlWriter) close() error {
+	return w.w.Flush()
+}
+
+type jsonlReader struct {
+	dec *json.Decoder
+}
+
+func newJSONLReader(r io.Reader) *jsonlReader {
+	return &jsonlReader{dec: json.NewDecoder(r)}
+}
+
+func (r *jsonlReader) readHeader() (ExportHeader, error) {
+	var h ExportHeader
+	err := r.dec.Decode(&h)
+	return h, err
+}
+
+func (r *jsonlReader) next() ([]Document, error) {
+	var d exportDocument
+	if err := r.dec.Decode(&d); err != nil {
+		return nil, err
+	}
+	return []Document{d.document()}, nil
+}
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"os"
+	"sync"
+)
+
+type fileLock struct {
+	path string
+	once sync.Once
+	f    *os.File
+	err  error
+}
+
+func newFileLock(path string) *fileLock {
+	return &fileLock{path: path}
+}
+
+func (l *fileLock) lock(exclusive bool) (func(), error) {
+	l.once.Do(func() {
+		l.f, l.err = os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, defaultFilePerm)
+	})
+	if l.err != nil {
+		return nil, l.err
+	}
+	if err := lockFile(l.f, exclusive); err != nil {
+		return nil, err
+	}
+	return func() { unlockFile(l.f) }, nil
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// Advisory file locks are only implemented on unix; elsewhere the store is
+// safe for concurrent goroutines but not for multiple processes.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
+
+func syncDir(dir string) error {
+	return nil
+}
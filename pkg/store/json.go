@@ -2,9 +2,13 @@ package store
 
 import (
 	"context"
-	"encoding/json"
+	"maps"
+	"math"
 	"os"
+	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/tik-choco-lab/rag/pkg/content"
@@ -13,167 +17,734 @@ import (
 const (
 	jstOffset       = 9 * 60 * 60
 	defaultFilePerm = 0644
+	lockFileSuffix  = ".lock"
+
+	unitLengthTolerance = 1e-4
 )
 
 var jst = time.FixedZone("Asia/Tokyo", jstOffset)
 
 type record struct {
-	DocID     string            `json:"doc_id"`
-	Hash      string            `json:"hash"`
-	Text      string            `json:"text"`
-	Embedding []float32         `json:"embedding"`
-	Metadata  map[string]string `json:"metadata"`
-	CreatedAt int64             `json:"created_at"`
-	Date      string            `json:"date"`
+	DocID      string            `json:"doc_id"`
+	ChunkIndex int               `json:"chunk_index"`
+	Hash       string            `json:"hash"`
+	Text       string            `json:"text"`
+	Embedding  []float32         `json:"embedding"`
+	Metadata   map[string]string `json:"metadata"`
+	CreatedAt  int64             `json:"created_at"`
+	Date       string            `json:"date"`
+
+	ParentIndex int    `json:"parent_index,omitempty"`
+	ParentText  string `json:"parent_text,omitempty"`
+	ChunkHash   string `json:"chunk_hash,omitempty"`
+
+	Version    int   `json:"version,omitempty"`
+	ReplacedAt int64 `json:"replaced_at,omitempty"`
+	ExpiresAt  int64 `json:"expires_at,omitempty"`
+
+	Signature      []uint64 `json:"signature,omitempty"`
+	DuplicateOf    string   `json:"duplicate_of,omitempty"`
+	DuplicateIndex int      `json:"duplicate_index,omitempty"`
+	Weight         float32  `json:"weight,omitempty"`
+
+	code content.Quantized
 }
 
-type jsonStore struct {
-	path    string
-	records []record
+func (r record) hit(score float32) hit {
+	return hit{
+		result: content.SearchResult{
+			DocID:       r.DocID,
+			ChunkIndex:  r.ChunkIndex,
+			ParentIndex: r.ParentIndex,
+			Text:        r.Text,
+			Score:       score,
+			Metadata:    r.Metadata,
+		},
+		duplicateOf: r.duplicateOf(),
+	}
 }
 
-func NewJSONStore(path string) Store {
-	s := &jsonStore{path: path}
-	s.load()
-	return s
+// detach copies an embedding that may point into a mapped snapshot.
+func (r record) detach() record {
+	r.Embedding = slices.Clone(r.Embedding)
+	return r
 }
 
-func (s *jsonStore) AddDocument(ctx context.Context, docID string, text string, metadata map[string]string, chunkSize, overlap int, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) error {
-	cleanText := content.CleanText(text)
-	newHash := content.CalculateHash(cleanText)
+func (r record) duplicateOf() ChunkRef {
+	return ChunkRef{DocID: r.DuplicateOf, Index: r.DuplicateIndex}
+}
 
-	duplicate := false
-	for _, r := range s.records {
-		if r.DocID == docID && r.Hash == newHash {
-			duplicate = true
-			break
-		}
+func (r record) chunk() Chunk {
+	return Chunk{
+		Index:       r.ChunkIndex,
+		Hash:        r.ChunkHash,
+		Text:        r.Text,
+		ParentIndex: r.ParentIndex,
+		ParentText:  r.ParentText,
+		Embedding:   r.Embedding,
+		Signature:   r.Signature,
+		DuplicateOf: r.duplicateOf(),
+		Weight:      r.Weight,
 	}
-	if duplicate {
-		return nil
+}
+
+// version treats records written before versioning as the first version.
+func (r record) version() int {
+	return max(r.Version, 1)
+}
+
+func (r record) replacedAt() time.Time {
+	if r.ReplacedAt == 0 {
+		return time.Time{}
 	}
+	return time.Unix(r.ReplacedAt, 0).In(jst)
+}
 
-	if err := s.DeleteDocument(ctx, docID); err != nil {
-		return err
+func (r record) expired(now int64) bool {
+	return r.ExpiresAt != 0 && r.ExpiresAt <= now
+}
+
+func (r record) info() DocumentInfo {
+	info := DocumentInfo{
+		DocID:      r.DocID,
+		Version:    r.version(),
+		Hash:       r.Hash,
+		Metadata:   r.Metadata,
+		ChunkCount: 1,
+		CreatedAt:  time.Unix(r.CreatedAt, 0).In(jst),
+		Date:       r.Date,
+	}
+	if r.ExpiresAt != 0 {
+		info.ExpiresAt = time.Unix(r.ExpiresAt, 0).In(jst)
+	}
+	return info
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+type storeStamp struct {
+	snapshot fileStamp
+	wal      fileStamp
+}
+
+type jsonCollection struct {
+	path         string
+	codec        snapshotCodec
+	quantization Quantization
+	lock         *fileLock
+	mu           sync.RWMutex
+	stamp        storeStamp
+	records      []record
+
+	// release unmaps the snapshot. Embeddings handed out are copied first.
+	release func() error
+
+	walOffset int64
+
+	// history is nil for a history itself.
+	history   *jsonCollection
+	retention RetentionOptions
+}
+
+func newJSONCollection(path string, codec snapshotCodec, quantization Quantization) *jsonCollection {
+	s := &jsonCollection{
+		path:         path,
+		codec:        codec,
+		quantization: quantization,
+		lock:         newFileLock(path + lockFileSuffix),
+	}
+	s.refresh()
+	return s
+}
+
+func (s *jsonCollection) AddChunks(ctx context.Context, doc Document, options AddOptions, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) (AddResult, error) {
+	docID, newHash := doc.DocID, doc.Hash
+	expiresAt := unixOrZero(options.ExpiresAt)
+	unchanged := func(current []record) bool {
+		return slices.ContainsFunc(current, func(r record) bool {
+			return r.Hash == newHash
+		})
 	}
 
-	chunks := content.SplitText(cleanText, chunkSize, overlap)
-	embeddings, err := embeddingsFunc(ctx, chunks)
+	current, err := s.documentRecords(docID)
 	if err != nil {
-		return err
+		return AddResult{}, err
+	}
+	if unchanged(current) {
+		var kept int
+		err := s.modify(func() []walEntry {
+			current := s.recordsOf(docID)
+			if !unchanged(current) {
+				return nil
+			}
+			kept = len(current)
+			return refreshRecords(current, doc.Metadata, expiresAt)
+		})
+		return AddResult{Kept: kept}, err
+	}
+	previous := make([]Chunk, len(current))
+	for i, r := range current {
+		previous[i] = r.chunk()
+	}
+
+	chunks, result, err := embedDocument(ctx, doc.Chunks, previous, options, s.duplicateSource(docID), embeddingsFunc)
+	if err != nil {
+		return AddResult{}, err
 	}
 
 	now := time.Now().In(jst)
 	timestamp := now.Unix()
 	isoDate := now.Format(time.RFC3339)
 
+	records := make([]record, len(chunks))
 	for i, chunk := range chunks {
-		s.records = append(s.records, record{
-			DocID:     docID,
-			Hash:      newHash,
-			Text:      chunk,
-			Embedding: embeddings[i],
-			Metadata:  metadata,
-			CreatedAt: timestamp,
-			Date:      isoDate,
-		})
+		records[i] = record{
+			DocID:       docID,
+			ChunkIndex:  chunk.Index,
+			Hash:        newHash,
+			Text:        chunk.Text,
+			Embedding:   chunk.Embedding,
+			Metadata:    doc.Metadata,
+			CreatedAt:   timestamp,
+			Date:        isoDate,
+			ParentIndex: chunk.ParentIndex,
+			ParentText:  chunk.ParentText,
+			ChunkHash:   chunk.Hash,
+			ExpiresAt:   expiresAt,
+
+			Signature:      chunk.Signature,
+			DuplicateOf:    chunk.DuplicateOf.DocID,
+			DuplicateIndex: chunk.DuplicateOf.Index,
+			Weight:         chunk.Weight,
+		}
 	}
 
-	return s.save()
+	// Another writer may have stored the document since it was read, so the
+	// hash is checked again under the lock that archives and replaces it.
+	var kept int
+	var replaced []record
+	var versionErr error
+	err = s.modifyThen(func() []walEntry {
+		current := s.recordsOf(docID)
+		if unchanged(current) {
+			kept = len(current)
+			return refreshRecords(current, doc.Metadata, expiresAt)
+		}
+		version, err := s.nextVersion(docID, current)
+		if err != nil {
+			versionErr = err
+			return nil
+		}
+		for i := range records {
+			records[i].Version = version
+		}
+		replaced = current
+		return []walEntry{{Op: walOpAdd, DocID: docID, Records: records}}
+	}, func() error {
+		return s.archive(docID, replaced, now)
+	})
+	if err == nil {
+		err = versionErr
+	}
+	if err != nil {
+		return AddResult{}, err
+	}
+	if kept > 0 {
+		return AddResult{Kept: kept}, nil
+	}
+	return result, nil
 }
 
-func (s *jsonStore) Search(ctx context.Context, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
-	var filteredChunks []string
-	var filteredEmbeddings [][]float32
+// refreshRecords returns no entry when current already has the metadata and
+// expiry of the new write.
+func refreshRecords(current []record, metadata map[string]string, expiresAt int64) []walEntry {
+	if len(current) == 0 || maps.Equal(current[0].Metadata, metadata) && current[0].ExpiresAt == expiresAt {
+		return nil
+	}
+	for i := range current {
+		current[i].Metadata = metadata
+		current[i].ExpiresAt = expiresAt
+	}
+	return []walEntry{{Op: walOpAdd, DocID: current[0].DocID, Records: current}}
+}
 
-	for _, r := range s.records {
-		if s.matchMetadata(r.Metadata, options.Metadata) {
-			filteredChunks = append(filteredChunks, r.Text)
-			filteredEmbeddings = append(filteredEmbeddings, r.Embedding)
+func (s *jsonCollection) PutDocument(ctx context.Context, doc Document) error {
+	records := make([]record, len(doc.Chunks))
+	for i, chunk := range doc.Chunks {
+		records[i] = record{
+			DocID:       doc.DocID,
+			ChunkIndex:  chunk.Index,
+			Hash:        doc.Hash,
+			Text:        chunk.Text,
+			Embedding:   chunk.Embedding,
+			Metadata:    doc.Metadata,
+			CreatedAt:   doc.CreatedAt.Unix(),
+			Date:        doc.Date,
+			ParentIndex: chunk.ParentIndex,
+			ParentText:  chunk.ParentText,
+			ChunkHash:   chunk.Hash,
+			Version:     doc.Version,
+			ExpiresAt:   unixOrZero(doc.ExpiresAt),
+
+			Signature:      chunk.Signature,
+			DuplicateOf:    chunk.DuplicateOf.DocID,
+			DuplicateIndex: chunk.DuplicateOf.Index,
+			Weight:         chunk.Weight,
 		}
 	}
+	return s.update(walEntry{Op: walOpAdd, DocID: doc.DocID, Records: records})
+}
 
-	if len(filteredChunks) == 0 {
-		return nil, nil
+func (s *jsonCollection) Search(ctx context.Context, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
+	archived, err := s.archived(options)
+	if err != nil {
+		return nil, err
 	}
 
-	return content.SearchTopK(queryEmbedding, filteredChunks, filteredEmbeddings, options.TopK, options.Threshold, options.MMRLambda), nil
+	var results []content.SearchResult
+	err = s.view(func() error {
+		var err error
+		results, err = s.search(ctx, queryEmbedding, s.selectRecords(archived, options), options)
+		return err
+	})
+	return results, err
 }
 
-func (s *jsonStore) RecencySearch(ctx context.Context, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
-	var filtered []record
-	var maxTS, minTS int64
+func (s *jsonCollection) RecencySearch(ctx context.Context, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
+	archived, err := s.archived(options)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, r := range s.records {
-		if s.matchMetadata(r.Metadata, options.Metadata) {
-			filtered = append(filtered, r)
-			if r.CreatedAt > maxTS {
-				maxTS = r.CreatedAt
-			}
-			if minTS == 0 || r.CreatedAt < minTS {
-				minTS = r.CreatedAt
-			}
+	var results []content.SearchResult
+	err = s.view(func() error {
+		var err error
+		results, err = s.recencySearch(ctx, queryEmbedding, s.selectRecords(archived, options), options)
+		return err
+	})
+	return results, err
+}
+
+func (s *jsonCollection) search(ctx context.Context, queryEmbedding []float32, records []record, options SearchOptions) ([]content.SearchResult, error) {
+	filtered := s.filter(records, options.Metadata)
+	if len(filtered) == 0 {
+		return nil, nil
+	}
+
+	var ranked []content.Ranked
+	if weighted(filtered) {
+		candidates := s.rank(queryEmbedding, filtered, s.poolSize(filtered, options), options.Threshold, 1.0)
+		for i, c := range candidates {
+			candidates[i].Score = c.Score * filtered[c.Index].chunk().weight()
 		}
+		ranked = content.SelectMMR(candidates, embeddings(filtered), options.sampleSize(), options.MMRLambda)
+	} else {
+		ranked = s.rank(queryEmbedding, filtered, options.sampleSize(), options.Threshold, options.MMRLambda)
+	}
+	hits := make([]hit, len(ranked))
+	for i, rk := range ranked {
+		hits[i] = filtered[rk.Index].hit(rk.Score)
 	}
+	results, err := collectResults(ctx, hits, options, parentText(records))
+	if err != nil {
+		return nil, err
+	}
+	return expandNeighbors(ctx, results, options, chunkRange(records))
+}
 
+func (s *jsonCollection) recencySearch(ctx context.Context, queryEmbedding []float32, records []record, options SearchOptions) ([]content.SearchResult, error) {
+	filtered := s.filter(records, options.Metadata)
 	if len(filtered) == 0 {
 		return nil, nil
 	}
 
-	chunks := make([]string, len(filtered))
-	embeddings := make([][]float32, len(filtered))
-	for i, r := range filtered {
-		chunks[i] = r.Text
-		embeddings[i] = r.Embedding
+	candidates := s.rank(queryEmbedding, filtered, s.poolSize(filtered, options), options.Threshold, 1.0)
+	now := options.Recency.now()
+	for i, c := range candidates {
+		r := filtered[c.Index]
+		timeScore := options.Recency.score(now, time.Unix(r.CreatedAt, 0), r.Metadata)
+		candidates[i].Score = blendRecency(c.Score*r.chunk().weight(), timeScore, options.RecencyWeight)
+	}
+
+	ranked := content.SelectMMR(candidates, embeddings(filtered), options.sampleSize(), options.MMRLambda)
+	hits := make([]hit, len(ranked))
+	for i, rk := range ranked {
+		hits[i] = filtered[rk.Index].hit(rk.Score)
+	}
+
+	results, err := collectResults(ctx, hits, options, parentText(records))
+	if err != nil {
+		return nil, err
 	}
+	return expandNeighbors(ctx, results, options, chunkRange(records))
+}
 
-	results := content.SearchTopK(queryEmbedding, chunks, embeddings, len(filtered), options.Threshold, 1.0)
+// poolSize is the number of candidates ranked before rescoring them. Without
+// quantization scoring every record costs no more than ranking some.
+func (s *jsonCollection) poolSize(filtered []record, options SearchOptions) int {
+	if s.quantization.Mode != content.QuantizeNone {
+		return options.sampleSize() * recencySampleMultiplier
+	}
+	return len(filtered)
+}
+
+func weighted(records []record) bool {
+	return slices.ContainsFunc(records, func(r record) bool {
+		return r.Weight > 0 && r.Weight != 1
+	})
+}
+
+func (s *jsonCollection) DeleteDocument(ctx context.Context, docID string) error {
+	var deleted []record
+	return s.modifyThen(func() []walEntry {
+		deleted = s.recordsOf(docID)
+		return []walEntry{{Op: walOpDelete, DocID: docID}}
+	}, func() error {
+		return s.archive(docID, deleted, time.Now().In(jst))
+	})
+}
 
-	for i := range results {
-		var ts int64
-		for _, r := range filtered {
-			if r.Text == results[i].Text {
-				ts = r.CreatedAt
-				break
+func (s *jsonCollection) ListDocuments(ctx context.Context, options ListOptions) ([]DocumentInfo, error) {
+	var docs []DocumentInfo
+	err := s.view(func() error {
+		index := make(map[string]int)
+		for _, r := range s.filter(s.records, options.Metadata) {
+			if i, ok := index[r.DocID]; ok {
+				docs[i].ChunkCount++
+				continue
 			}
+			index[r.DocID] = len(docs)
+			docs = append(docs, r.info())
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		timeScore := float32(0)
-		if maxTS != minTS {
-			timeScore = float32(ts-minTS) / float32(maxTS-minTS)
+	slices.SortFunc(docs, func(a, b DocumentInfo) int {
+		return strings.Compare(a.DocID, b.DocID)
+	})
+	return paginate(docs, options.Offset, options.Limit), nil
+}
+
+func (s *jsonCollection) GetDocument(ctx context.Context, docID string) (*Document, error) {
+	now := time.Now().Unix()
+	var doc *Document
+	err := s.view(func() error {
+		for _, r := range s.records {
+			if r.DocID != docID || r.expired(now) {
+				continue
+			}
+			if doc == nil {
+				doc = &Document{DocumentInfo: r.info()}
+				doc.Metadata = maps.Clone(doc.Metadata)
+			} else {
+				doc.ChunkCount++
+			}
+			chunk := r.detach().chunk()
+			chunk.Signature = slices.Clone(chunk.Signature)
+			doc.Chunks = append(doc.Chunks, chunk)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrNotFound
+	}
 
-		results[i].Score = (1.0-options.RecencyWeight)*results[i].Score + options.RecencyWeight*timeScore
+	slices.SortFunc(doc.Chunks, func(a, b Chunk) int {
+		return a.Index - b.Index
+	})
+	return doc, nil
+}
+
+func (s *jsonCollection) Purge(ctx context.Context) (int, error) {
+	now := time.Now().Unix()
+	var purged int
+	err := s.modify(func() []walEntry {
+		var entries []walEntry
+		seen := make(map[string]bool)
+		for _, r := range s.records {
+			if r.expired(now) && !seen[r.DocID] {
+				seen[r.DocID] = true
+				entries = append(entries, walEntry{Op: walOpDelete, DocID: r.DocID})
+			}
+		}
+		purged = len(entries)
+		return entries
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	slices.SortFunc(results, func(a, b content.SearchResult) int {
-		if a.Score > b.Score {
-			return -1
+	// Versions that outlived the retention age go as well, since archiving
+	// only trims the history of the document it writes.
+	dropped := func(r record) bool {
+		return r.expired(now) || s.retention.outlived(r.replacedAt(), time.Unix(now, 0))
+	}
+	err = s.history.modify(func() []walEntry {
+		kept := make(map[string][]record)
+		for _, r := range s.history.records {
+			if dropped(r) {
+				kept[r.DocID] = nil
+			}
 		}
-		if a.Score < b.Score {
-			return 1
+		for _, r := range s.history.records {
+			if records, ok := kept[r.DocID]; ok && !dropped(r) {
+				kept[r.DocID] = append(records, r)
+			}
 		}
-		return 0
+
+		var entries []walEntry
+		for docID, records := range kept {
+			entries = append(entries, walEntry{Op: walOpAdd, DocID: docID, Records: records})
+		}
+		return entries
 	})
+	return purged, err
+}
 
-	if len(results) > options.TopK {
-		return results[:options.TopK], nil
+func (s *jsonCollection) UpdateMetadata(ctx context.Context, docID string, metadata map[string]string) error {
+	found := false
+	err := s.modify(func() []walEntry {
+		found = slices.ContainsFunc(s.records, func(r record) bool {
+			return r.DocID == docID
+		})
+		if !found {
+			return nil
+		}
+		return []walEntry{{Op: walOpMetadata, DocID: docID, Metadata: metadata}}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
 	}
-	return results, nil
+	return nil
 }
 
-func (s *jsonStore) DeleteDocument(ctx context.Context, docID string) error {
+func (s *jsonCollection) CountChunks(ctx context.Context, metadata map[string]string) (int, error) {
+	var n int
+	err := s.view(func() error {
+		n = len(s.filter(s.records, metadata))
+		return nil
+	})
+	return n, err
+}
+
+func (s *jsonCollection) dimension() (int, error) {
+	var dim int
+	err := s.view(func() error {
+		if len(s.records) > 0 {
+			dim = len(s.records[0].Embedding)
+		}
+		return nil
+	})
+	return dim, err
+}
+
+func (s *jsonCollection) deleteRecords(docID string) []record {
 	var newRecords []record
 	for _, r := range s.records {
 		if r.DocID != docID {
 			newRecords = append(newRecords, r)
 		}
 	}
-	s.records = newRecords
-	return s.save()
+	return newRecords
 }
 
-func (s *jsonStore) matchMetadata(recordMeta, searchMeta map[string]string) bool {
+func (s *jsonCollection) rank(queryEmbedding []float32, filtered []record, k int, threshold, mmrLambda float32) []content.Ranked {
+	if s.quantization.Mode == content.QuantizeNone {
+		return content.RankNormalized(content.Normalize(queryEmbedding), embeddings(filtered), k, threshold, mmrLambda)
+	}
+
+	codes := make([]content.Quantized, len(filtered))
+	for i, r := range filtered {
+		codes[i] = r.code
+	}
+	return content.RankQuantized(queryEmbedding, embeddings(filtered), codes, s.quantization.Mode, k, s.quantization.Rescore, threshold, mmrLambda)
+}
+
+func (s *jsonCollection) QuantizationRecall(ctx context.Context, queries [][]float32, k int) (content.RecallReport, error) {
+	var report content.RecallReport
+	err := s.view(func() error {
+		report = content.MeasureRecall(queries, embeddings(s.records), s.quantization.Mode, k, s.quantization.Rescore)
+		return nil
+	})
+	return report, err
+}
+
+// prepare normalises embeddings, builds quantized codes and fixes up records
+// of older files. Unless copyVectors is set, unit-length embeddings stay
+// where they are so a mapped snapshot is not copied into memory.
+func (s *jsonCollection) prepare(records []record, copyVectors bool) {
+	type parentKey struct {
+		docID          string
+		version, index int
+	}
+	parents := make(map[parentKey]bool)
+	for i := range records {
+		if r := records[i]; r.ParentText != "" {
+			key := parentKey{docID: r.DocID, version: r.version(), index: r.ParentIndex}
+			if parents[key] {
+				records[i].ParentText = ""
+			}
+			parents[key] = true
+		}
+	}
+	indexLegacyChunks(records)
+
+	for i := range records {
+		if copyVectors || !unitLength(records[i].Embedding) {
+			records[i].Embedding = content.Normalize(records[i].Embedding)
+		}
+		if s.quantization.Mode != content.QuantizeNone {
+			records[i].code = content.Quantize(records[i].Embedding, s.quantization.Mode)
+		}
+	}
+}
+
+func unitLength(v []float32) bool {
+	var norm float64
+	for _, x := range v {
+		norm += float64(x) * float64(x)
+	}
+	return math.Abs(norm-1) < unitLengthTolerance
+}
+
+// indexLegacyChunks numbers the chunks of older files, which all read as 0.
+func indexLegacyChunks(records []record) {
+	type docKey struct {
+		docID   string
+		version int
+	}
+	counts := make(map[docKey]int)
+	indexed := make(map[docKey]bool)
+	for _, r := range records {
+		key := docKey{docID: r.DocID, version: r.version()}
+		counts[key]++
+		indexed[key] = indexed[key] || r.ChunkIndex != 0
+	}
+
+	next := make(map[docKey]int)
+	for i, r := range records {
+		key := docKey{docID: r.DocID, version: r.version()}
+		if counts[key] > 1 && !indexed[key] {
+			records[i].ChunkIndex = next[key]
+			next[key]++
+		}
+	}
+}
+
+func embeddings(records []record) [][]float32 {
+	embs := make([][]float32, len(records))
+	for i, r := range records {
+		embs[i] = r.Embedding
+	}
+	return embs
+}
+
+func parentText(records []record) parentTextFunc {
+	return func(ctx context.Context, docID string, parentIndex int) (string, error) {
+		for _, r := range records {
+			if r.DocID == docID && r.ParentIndex == parentIndex && r.ParentText != "" {
+				return r.ParentText, nil
+			}
+		}
+		return "", nil
+	}
+}
+
+func chunkRange(records []record) chunkRangeFunc {
+	return func(ctx context.Context, docID string, from, to int) ([]Chunk, error) {
+		var chunks []Chunk
+		for _, r := range records {
+			if r.DocID == docID && r.ChunkIndex >= from && r.ChunkIndex <= to {
+				chunks = append(chunks, Chunk{Index: r.ChunkIndex, Text: r.Text, ParentIndex: r.ParentIndex})
+			}
+		}
+		slices.SortFunc(chunks, func(a, b Chunk) int {
+			return a.Index - b.Index
+		})
+		return chunks, nil
+	}
+}
+
+func (s *jsonCollection) duplicateSource(docID string) duplicateSource {
+	others := func() []record {
+		var records []record
+		for _, r := range s.filter(s.records, nil) {
+			if r.DocID != docID {
+				records = append(records, r)
+			}
+		}
+		return records
+	}
+
+	return duplicateSource{
+		signatures: func(ctx context.Context, bands []uint64) ([]dedupCandidate, error) {
+			wanted := make(map[uint64]bool)
+			for _, b := range bands {
+				wanted[b] = true
+			}
+			var candidates []dedupCandidate
+			err := s.view(func() error {
+				for _, r := range others() {
+					if slices.ContainsFunc(signatureBands(r.Signature), func(b uint64) bool { return wanted[b] }) {
+						candidates = append(candidates, dedupCandidate{
+							ref:         ChunkRef{DocID: r.DocID, Index: r.ChunkIndex},
+							signature:   r.Signature,
+							duplicateOf: r.duplicateOf(),
+						})
+					}
+				}
+				return nil
+			})
+			return candidates, err
+		},
+		nearest: func(ctx context.Context, embedding []float32) (ChunkRef, float32, error) {
+			var ref ChunkRef
+			var best float32
+			err := s.view(func() error {
+				for _, r := range others() {
+					if score := content.Dot(embedding, r.Embedding); ref.DocID == "" || score > best {
+						best = score
+						ref = dedupCandidate{ref: ChunkRef{DocID: r.DocID, Index: r.ChunkIndex}, duplicateOf: r.duplicateOf()}.original()
+					}
+				}
+				return nil
+			})
+			return ref, best, err
+		},
+	}
+}
+
+func (s *jsonCollection) filter(records []record, metadata map[string]string) []record {
+	now := time.Now().Unix()
+	var filtered []record
+	for _, r := range records {
+		if !r.expired(now) && s.matchMetadata(r.Metadata, metadata) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+func (s *jsonCollection) matchMetadata(recordMeta, searchMeta map[string]string) bool {
 	for k, v := range searchMeta {
 		if recordMeta[k] != v {
 			return false
@@ -182,21 +753,193 @@ func (s *jsonStore) matchMetadata(recordMeta, searchMeta map[string]string) bool
 	return true
 }
 
-func (s *jsonStore) save() error {
-	data, err := json.MarshalIndent(s.records, "", "  ")
+func (s *jsonCollection) view(fn func() error) error {
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn()
+}
+
+func (s *jsonCollection) update(entries ...walEntry) error {
+	return s.modify(func() []walEntry {
+		return entries
+	})
+}
+
+func (s *jsonCollection) modify(fn func() []walEntry) error {
+	return s.modifyThen(fn, nil)
+}
+
+// then runs once the entries are logged, before the locks are released.
+func (s *jsonCollection) modifyThen(fn func() []walEntry, then func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.reloadIfChanged(); err != nil {
+		return err
+	}
+	entries := fn()
+	if len(entries) == 0 {
+		return nil
+	}
+	for _, e := range entries {
+		s.apply(e)
+	}
+	if err := s.appendWAL(entries); err != nil {
+		s.stamp = storeStamp{}
+		return err
+	}
+	if then != nil {
+		if err := then(); err != nil {
+			return err
+		}
+	}
+	if s.walOffset > max(s.stamp.snapshot.size, minCompactSize) {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *jsonCollection) refresh() error {
+	stamp, err := s.currentStamp()
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	fresh := stamp == s.stamp
+	s.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return s.reloadIfChanged()
+}
+
+func (s *jsonCollection) reloadIfChanged() error {
+	stamp, err := s.currentStamp()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(s.path, data, defaultFilePerm)
+	if stamp == s.stamp {
+		return nil
+	}
+
+	if stamp.snapshot != s.stamp.snapshot || stamp.wal.size < s.walOffset {
+		if err := s.load(); err != nil {
+			s.stamp = storeStamp{}
+			return err
+		}
+		s.walOffset = 0
+	}
+	if err := s.replayWAL(); err != nil {
+		s.stamp = storeStamp{}
+		return err
+	}
+	s.stamp = stamp
+	return nil
 }
 
-func (s *jsonStore) load() error {
+func (s *jsonCollection) currentStamp() (storeStamp, error) {
+	snapshot, err := statFile(s.path)
+	if err != nil {
+		return storeStamp{}, err
+	}
+	wal, err := statFile(s.walPath())
+	if err != nil {
+		return storeStamp{}, err
+	}
+	return storeStamp{snapshot: snapshot, wal: wal}, nil
+}
+
+func (s *jsonCollection) save() error {
+	data, err := s.codec.encode(s.records)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, defaultFilePerm)
+}
+
+func (s *jsonCollection) load() error {
+	s.records = nil
+	if err := s.unmap(); err != nil {
+		return err
+	}
 	if _, err := os.Stat(s.path); os.IsNotExist(err) {
 		return nil
 	}
-	data, err := os.ReadFile(s.path)
+	records, release, err := s.codec.load(s.path)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, &s.records)
+	s.records, s.release = records, release
+	s.prepare(s.records, false)
+	if s.quantization.Mode != content.QuantizeNone && s.release == nil {
+		s.release, err = spillVectors(filepath.Dir(s.path), s.records)
+	}
+	return err
+}
+
+func (s *jsonCollection) unmap() error {
+	if s.release == nil {
+		return nil
+	}
+	release := s.release
+	s.release = nil
+	return release()
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fileStamp{}, nil
+	}
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
 }
@@ -0,0 +1,602 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tik-choco-lab/rag/pkg/content"
+)
+
+const registryFileSuffix = ".collections"
+
+type Quantization struct {
+	Mode    content.QuantizationMode
+	Rescore int
+}
+
+type JSONOptions struct {
+	VectorType   VectorType
+	Quantization Quantization
+	Retention    RetentionOptions
+}
+
+// jsonStore keeps the default collection in path and the others in siblings
+// such as store.manuals.json, each with a .history file.
+type jsonStore struct {
+	path         string
+	codec        snapshotCodec
+	quantization Quantization
+	retention    RetentionOptions
+	registry     *jsonRegistry
+
+	mu          sync.Mutex
+	collections map[string]*jsonCollection
+}
+
+func NewJSONStore(path string, options JSONOptions) Store {
+	return newJSONStore(path, jsonCodec{}, options)
+}
+
+func NewBinaryStore(path string, options JSONOptions) Store {
+	return newJSONStore(path, binaryCodec{vectorType: options.VectorType}, options)
+}
+
+func newJSONStore(path string, codec snapshotCodec, options JSONOptions) *jsonStore {
+	return &jsonStore{
+		path:         path,
+		codec:        codec,
+		quantization: options.Quantization,
+		retention:    options.Retention,
+		registry:     newJSONRegistry(path + registryFileSuffix),
+		collections:  make(map[string]*jsonCollection),
+	}
+}
+
+func ConvertJSONToBinary(src, dst string, vectorType VectorType) error {
+	from := newJSONStore(src, jsonCodec{}, JSONOptions{})
+	to := newJSONStore(dst, binaryCodec{vectorType: vectorType}, JSONOptions{})
+
+	entries, err := from.registry.list()
+	if err != nil {
+		return err
+	}
+	converted := make([]registryEntry, len(entries))
+	for i, e := range entries {
+		converted[i] = registryEntry{Collection: e.Collection}
+	}
+	if err := to.registry.modify(func([]registryEntry) ([]registryEntry, error) {
+		return converted, nil
+	}); err != nil {
+		return err
+	}
+
+	for _, c := range withDefault(collectionsOf(entries)) {
+		e, err := from.describe(c.Name)
+		if err != nil {
+			return err
+		}
+		src, dst := from.open(from.entryPath(e)), to.open(to.collectionPath(c.Name))
+		if err := convertCollection(src, dst); err != nil {
+			return err
+		}
+		if err := convertCollection(src.history, dst.history); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func convertCollection(from, to *jsonCollection) error {
+	var records []record
+	err := from.view(func() error {
+		records = from.records
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	to.mu.Lock()
+	defer to.mu.Unlock()
+
+	unlock, err := to.lock.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	to.records = records
+	return to.compact()
+}
+
+func (s *jsonStore) CreateCollection(ctx context.Context, collection Collection) error {
+	name, err := collectionName(collection.Name)
+	if err != nil {
+		return err
+	}
+	collection.Name = name
+	if collection.CreatedAt.IsZero() {
+		collection.CreatedAt = time.Now().In(jst)
+	}
+
+	return s.registry.modify(func(entries []registryEntry) ([]registryEntry, error) {
+		if findEntry(entries, name) >= 0 {
+			return nil, ErrCollectionExists
+		}
+		return append(entries, registryEntry{Collection: collection, File: s.freeFile(entries, name)}), nil
+	})
+}
+
+func (s *jsonStore) ListCollections(ctx context.Context) ([]Collection, error) {
+	entries, err := s.registry.list()
+	if err != nil {
+		return nil, err
+	}
+	return withDefault(collectionsOf(entries)), nil
+}
+
+func (s *jsonStore) DropCollection(ctx context.Context, name string) error {
+	name, err := collectionName(name)
+	if err != nil {
+		return err
+	}
+
+	path := s.collectionPath(name)
+	err = s.registry.modify(func(entries []registryEntry) ([]registryEntry, error) {
+		i := findEntry(entries, name)
+		if i < 0 {
+			if name != DefaultCollection {
+				return nil, ErrCollectionNotFound
+			}
+			return entries, nil
+		}
+		path = s.entryPath(entries[i])
+		return slices.Delete(entries, i, i+1), nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.remove(path)
+}
+
+// SwapCollection is a single registry write, so readers see either the old
+// or the new data.
+func (s *jsonStore) SwapCollection(ctx context.Context, collection string, shadow string) error {
+	name, err := collectionName(collection)
+	if err != nil {
+		return err
+	}
+	if shadow, err = collectionName(shadow); err != nil {
+		return err
+	}
+
+	var old string
+	err = s.registry.modify(func(entries []registryEntry) ([]registryEntry, error) {
+		j := findEntry(entries, shadow)
+		if j < 0 {
+			return nil, ErrCollectionNotFound
+		}
+		i := findEntry(entries, name)
+		if i < 0 {
+			if name != DefaultCollection {
+				return nil, ErrCollectionNotFound
+			}
+			entries = append(entries, registryEntry{Collection: Collection{Name: name, CreatedAt: time.Now().In(jst)}})
+			i = len(entries) - 1
+		}
+
+		old = s.entryPath(entries[i])
+		entries[i].EmbeddingModel = entries[j].EmbeddingModel
+		entries[i].Dimension = entries[j].Dimension
+		entries[i].File = filepath.Base(s.entryPath(entries[j]))
+		return slices.Delete(entries, j, j+1), nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.remove(old)
+}
+
+func (s *jsonStore) AddDocument(ctx context.Context, collection string, docID string, text string, metadata map[string]string, options AddOptions, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) (AddResult, error) {
+	return s.AddChunks(ctx, collection, newDocument(docID, text, metadata, options), options, embeddingsFunc)
+}
+
+func (s *jsonStore) AddChunks(ctx context.Context, collection string, doc Document, options AddOptions, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) (AddResult, error) {
+	c, info, err := s.collection(ctx, collection, true)
+	if err != nil {
+		return AddResult{}, err
+	}
+	// Reused vectors must match the model even when nothing is embedded.
+	if err := info.checkEmbedding(options.EmbeddingModel, info.Dimension); err != nil {
+		return AddResult{}, err
+	}
+	dim, err := embeddingDimension(providedEmbeddings(doc.Chunks))
+	if err != nil {
+		return AddResult{}, err
+	}
+	if dim > 0 {
+		if err := s.bindEmbedding(c, info, options.EmbeddingModel, dim); err != nil {
+			return AddResult{}, err
+		}
+	}
+	options.ExpiresAt = options.expiresAt(info, time.Now())
+
+	var embed func(ctx context.Context, chunks []string) ([][]float32, error)
+	if embeddingsFunc != nil {
+		embed = func(ctx context.Context, chunks []string) ([][]float32, error) {
+			embeddings, err := embeddingsFunc(ctx, chunks)
+			if err != nil {
+				return nil, err
+			}
+			dim, err := embeddingDimension(embeddings)
+			if err != nil {
+				return nil, err
+			}
+			return embeddings, s.bindEmbedding(c, info, options.EmbeddingModel, dim)
+		}
+	}
+	return c.AddChunks(ctx, completeHashes(doc), options, embed)
+}
+
+func (s *jsonStore) PutDocument(ctx context.Context, collection string, doc Document) error {
+	c, info, err := s.collection(ctx, collection, true)
+	if err != nil {
+		return err
+	}
+	dim, err := embeddingDimension(chunkEmbeddings(doc.Chunks))
+	if err != nil {
+		return err
+	}
+	if err := s.bindEmbedding(c, info, "", dim); err != nil {
+		return err
+	}
+	return c.PutDocument(ctx, doc)
+}
+
+func (s *jsonStore) bindEmbedding(c *jsonCollection, info Collection, model string, dim int) error {
+	if changed, err := info.bindEmbedding(model, dim); err != nil || !changed {
+		return err
+	}
+
+	stored, err := c.dimension()
+	if err != nil {
+		return err
+	}
+	if stored > 0 && stored != dim {
+		return fmt.Errorf("%w: collection %q holds vectors of dimension %d, got %d", ErrEmbeddingMismatch, info.Name, stored, dim)
+	}
+
+	return s.registry.modify(func(entries []registryEntry) ([]registryEntry, error) {
+		i := findEntry(entries, info.Name)
+		if i < 0 {
+			entries = append(entries, registryEntry{Collection: Collection{Name: info.Name, CreatedAt: time.Now().In(jst)}})
+			i = len(entries) - 1
+		}
+		_, err := entries[i].bindEmbedding(model, dim)
+		return entries, err
+	})
+}
+
+func (s *jsonStore) Search(ctx context.Context, collection string, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	c, info, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := info.checkEmbedding(options.EmbeddingModel, len(queryEmbedding)); err != nil {
+		return nil, err
+	}
+	return c.Search(ctx, queryEmbedding, options)
+}
+
+func (s *jsonStore) RecencySearch(ctx context.Context, collection string, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	c, info, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := info.checkEmbedding(options.EmbeddingModel, len(queryEmbedding)); err != nil {
+		return nil, err
+	}
+	return c.RecencySearch(ctx, queryEmbedding, options)
+}
+
+func (s *jsonStore) DeleteDocument(ctx context.Context, collection string, docID string) error {
+	c, _, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return err
+	}
+	return c.DeleteDocument(ctx, docID)
+}
+
+func (s *jsonStore) ListDocuments(ctx context.Context, collection string, options ListOptions) ([]DocumentInfo, error) {
+	c, _, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return nil, err
+	}
+	return c.ListDocuments(ctx, options)
+}
+
+func (s *jsonStore) GetDocument(ctx context.Context, collection string, docID string) (*Document, error) {
+	c, _, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetDocument(ctx, docID)
+}
+
+func (s *jsonStore) UpdateMetadata(ctx context.Context, collection string, docID string, metadata map[string]string) error {
+	c, _, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return err
+	}
+	return c.UpdateMetadata(ctx, docID, metadata)
+}
+
+func (s *jsonStore) CountChunks(ctx context.Context, collection string, metadata map[string]string) (int, error) {
+	c, _, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return 0, err
+	}
+	return c.CountChunks(ctx, metadata)
+}
+
+func (s *jsonStore) ListVersions(ctx context.Context, collection string, docID string) ([]VersionInfo, error) {
+	c, _, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return nil, err
+	}
+	return c.ListVersions(ctx, docID)
+}
+
+func (s *jsonStore) Purge(ctx context.Context, collection string) (int, error) {
+	c, _, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return 0, err
+	}
+	return c.Purge(ctx)
+}
+
+func (s *jsonStore) LinkDuplicates(ctx context.Context, collection string, docID string, chunks []Chunk, options DedupOptions) error {
+	if err := options.validate(); err != nil || options.Method == DedupNone {
+		return err
+	}
+	c, _, err := s.collection(ctx, collection, false)
+	if errors.Is(err, ErrCollectionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return linkDuplicates(ctx, chunks, options, c.duplicateSource(docID))
+}
+
+func (s *jsonStore) Compact(ctx context.Context, collection string) error {
+	c, _, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return err
+	}
+	return c.Compact(ctx)
+}
+
+func (s *jsonStore) QuantizationRecall(ctx context.Context, collection string, queries [][]float32, k int) (content.RecallReport, error) {
+	c, _, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return content.RecallReport{}, err
+	}
+	return c.QuantizationRecall(ctx, queries, k)
+}
+
+func (s *jsonStore) collection(ctx context.Context, name string, create bool) (*jsonCollection, Collection, error) {
+	name, err := collectionName(name)
+	if err != nil {
+		return nil, Collection{}, err
+	}
+
+	e, err := s.describe(name)
+	if errors.Is(err, ErrCollectionNotFound) && create {
+		err = s.CreateCollection(ctx, Collection{Name: name})
+		if err == nil || errors.Is(err, ErrCollectionExists) {
+			e, err = s.describe(name)
+		}
+	}
+	if err != nil {
+		return nil, Collection{}, err
+	}
+
+	return s.open(s.entryPath(e)), e.Collection, nil
+}
+
+func (s *jsonStore) describe(name string) (registryEntry, error) {
+	entries, err := s.registry.list()
+	if err != nil {
+		return registryEntry{}, err
+	}
+	if i := findEntry(entries, name); i >= 0 {
+		return entries[i], nil
+	}
+	if name == DefaultCollection {
+		return registryEntry{Collection: Collection{Name: name}}, nil
+	}
+	return registryEntry{}, ErrCollectionNotFound
+}
+
+func (s *jsonStore) open(path string) *jsonCollection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.collections[path]
+	if !ok {
+		c = s.newCollection(path)
+		s.collections[path] = c
+	}
+	return c
+}
+
+func (s *jsonStore) newCollection(path string) *jsonCollection {
+	c := newJSONCollection(path, s.codec, s.quantization)
+	c.history = newJSONCollection(path+historyFileSuffix, s.codec, s.quantization)
+	c.retention = s.retention
+	return c
+}
+
+func (s *jsonStore) remove(path string) error {
+	s.mu.Lock()
+	c, ok := s.collections[path]
+	if !ok {
+		c = s.newCollection(path)
+	}
+	delete(s.collections, path)
+	s.mu.Unlock()
+	return c.drop()
+}
+
+func (s *jsonStore) collectionPath(name string) string {
+	if name == DefaultCollection {
+		return s.path
+	}
+	ext := filepath.Ext(s.path)
+	return strings.TrimSuffix(s.path, ext) + "." + name + ext
+}
+
+func (s *jsonStore) entryPath(e registryEntry) string {
+	if e.File == "" {
+		return s.collectionPath(e.Name)
+	}
+	return filepath.Join(filepath.Dir(s.path), e.File)
+}
+
+// freeFile numbers the file when a swapped collection already uses the name.
+func (s *jsonStore) freeFile(entries []registryEntry, name string) string {
+	used := make(map[string]bool)
+	for _, e := range entries {
+		used[s.entryPath(e)] = true
+	}
+	if findEntry(entries, DefaultCollection) < 0 {
+		used[s.path] = true
+	}
+
+	path := s.collectionPath(name)
+	ext := filepath.Ext(path)
+	for n := 2; used[path] && name != DefaultCollection; n++ {
+		path = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(s.collectionPath(name), ext), n, ext)
+	}
+	return filepath.Base(path)
+}
+
+// File is relative to the store directory.
+type registryEntry struct {
+	Collection
+	File string `json:"file,omitempty"`
+}
+
+func findEntry(entries []registryEntry, name string) int {
+	return slices.IndexFunc(entries, func(e registryEntry) bool {
+		return e.Name == name
+	})
+}
+
+func collectionsOf(entries []registryEntry) []Collection {
+	collections := make([]Collection, len(entries))
+	for i, e := range entries {
+		collections[i] = e.Collection
+	}
+	return collections
+}
+
+// jsonRegistry caches the parsed file until it changes. mu is needed as well
+// as the file lock, which the goroutines of a process share.
+type jsonRegistry struct {
+	path string
+	lock *fileLock
+	mu   sync.Mutex
+
+	stamp   fileStamp
+	entries []registryEntry
+	cached  bool
+}
+
+func newJSONRegistry(path string) *jsonRegistry {
+	return &jsonRegistry{
+		path: path,
+		lock: newFileLock(path + lockFileSuffix),
+	}
+}
+
+func (r *jsonRegistry) list() ([]registryEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	unlock, err := r.lock.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return r.read()
+}
+
+func (r *jsonRegistry) modify(fn func([]registryEntry) ([]registryEntry, error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	unlock, err := r.lock.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, err := r.read()
+	if err != nil {
+		return err
+	}
+	if entries, err = fn(entries); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	r.cached = false
+	if err := writeFileAtomic(r.path, data, defaultFilePerm); err != nil {
+		return err
+	}
+	if r.stamp, err = statFile(r.path); err != nil {
+		return err
+	}
+	r.entries, r.cached = slices.Clone(entries), true
+	return nil
+}
+
+func (r *jsonRegistry) read() ([]registryEntry, error) {
+	stamp, err := statFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if !r.cached || stamp != r.stamp {
+		data, err := os.ReadFile(r.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		var entries []registryEntry
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &entries); err != nil {
+				return nil, err
+			}
+		}
+		r.stamp, r.entries, r.cached = stamp, entries, true
+	}
+	return slices.Clone(r.entries), nil
+}
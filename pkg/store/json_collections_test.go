@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCreateCollectionConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := NewJSONStore(filepath.Join(t.TempDir(), "store.json"), JSONOptions{})
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.CreateCollection(ctx, Collection{Name: fmt.Sprintf("c%02d", i)})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	collections, err := s.ListCollections(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, c := range collections {
+		names[c.Name] = true
+	}
+	for i := range n {
+		if name := fmt.Sprintf("c%02d", i); !names[name] {
+			t.Errorf("collection %s is missing", name)
+		}
+	}
+}
+
+func TestSearchTopKBounds(t *testing.T) {
+	s := NewJSONStore(filepath.Join(t.TempDir(), "store.json"), JSONOptions{})
+	checkTopKBounds(t, s)
+}
+
+// checkTopKBounds adds a document to s and expects searches asking for a
+// negative or excessive number of results to fail.
+func checkTopKBounds(t *testing.T, s Store) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := s.AddDocument(ctx, "", "doc", "some text", nil, AddOptions{ChunkSize: 100}, testEmbeddings); err != nil {
+		t.Fatal(err)
+	}
+
+	query := []float32{1, 0, 0}
+	for _, k := range []int{-1, maxTopK + 1, 1 << 62} {
+		if _, err := s.Search(ctx, "", query, SearchOptions{TopK: k, MMRLambda: 1}); err == nil {
+			t.Errorf("Search with TopK %d succeeded", k)
+		}
+		if _, err := s.RecencySearch(ctx, "", query, SearchOptions{TopK: k, MMRLambda: 1}); err == nil {
+			t.Errorf("RecencySearch with TopK %d succeeded", k)
+		}
+	}
+	if _, err := s.Search(ctx, "", query, SearchOptions{TopK: maxTopK, MMRLambda: 1}); err != nil {
+		t.Errorf("Search with TopK %d: %v", maxTopK, err)
+	}
+}
+
+// testEmbeddings embeds every chunk as the same unit vector.
+func testEmbeddings(ctx context.Context, chunks []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(chunks))
+	for i := range chunks {
+		embeddings[i] = []float32{1, 0, 0}
+	}
+	return embeddings, nil
+}
+
+func TestReaddRefreshesDocument(t *testing.T) {
+	s := NewJSONStore(filepath.Join(t.TempDir(), "store.json"), JSONOptions{})
+	checkReaddRefreshes(t, s)
+}
+
+// checkReaddRefreshes adds a document twice with the same text and expects
+// the second write to update its metadata and expiry, and an expired
+// document to be hidden from GetDocument.
+func checkReaddRefreshes(t *testing.T, s Store) {
+	t.Helper()
+	ctx := context.Background()
+	options := AddOptions{ChunkSize: 100, ExpiresAt: time.Now().Add(-time.Minute)}
+	if _, err := s.AddDocument(ctx, "", "doc", "some text", map[string]string{"v": "1"}, options, testEmbeddings); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetDocument(ctx, "", "doc"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetDocument of an expired document: %v, want ErrNotFound", err)
+	}
+
+	options.ExpiresAt = time.Now().Add(time.Hour).Truncate(time.Second)
+	result, err := s.AddDocument(ctx, "", "doc", "some text", map[string]string{"v": "2"}, options, testEmbeddings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Kept == 0 || result.Added != 0 {
+		t.Errorf("re-adding the same text = %+v, want the chunks kept", result)
+	}
+	doc, err := s.GetDocument(ctx, "", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Metadata["v"] != "2" || !doc.ExpiresAt.Equal(options.ExpiresAt) {
+		t.Errorf("document after re-adding has metadata %v and expiry %v, want v=2 and %v", doc.Metadata, doc.ExpiresAt, options.ExpiresAt)
+	}
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tik-choco-lab/rag/pkg/content"
+)
+
+// unitEmbeddings embeds the i-th chunk of each call as the i-th unit vector.
+func unitEmbeddings(ctx context.Context, chunks []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(chunks))
+	for i := range chunks {
+		embeddings[i] = make([]float32, 8)
+		embeddings[i][i] = 1
+	}
+	return embeddings, nil
+}
+
+func TestSearchStitchesNeighbors(t *testing.T) {
+	ctx := context.Background()
+	s := NewJSONStore(filepath.Join(t.TempDir(), "store.json"), JSONOptions{})
+	// Five chunks starting at 0, 7, 14, 21 and 28.
+	const text = "abcdefghijklmnopqrstuvwxyz0123456789"
+	options := AddOptions{ChunkSize: 10, Overlap: 3}
+	if _, err := s.AddDocument(ctx, "", "doc", text, nil, options, unitEmbeddings); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		query     []float32
+		topK      int
+		neighbors int
+		want      []string
+	}{
+		{"no neighbors", []float32{0, 1}, 1, 0, []string{"hijklmnopq"}},
+		{"one neighbor", []float32{0, 1}, 1, 1, []string{text[:24]}},
+		{"window at the start", []float32{1}, 1, 1, []string{text[:17]}},
+		{"touching windows merge", []float32{1, 0, 0, 1}, 2, 1, []string{text}},
+		{"separate windows", []float32{1, 0, 0, 0, 1}, 2, 1, []string{text[:17], text[21:]}},
+	}
+	for _, tt := range tests {
+		query := make([]float32, 8)
+		copy(query, tt.query)
+		results, err := s.Search(ctx, "", query, SearchOptions{TopK: tt.topK, MMRLambda: 1, Threshold: 0.5, Neighbors: tt.neighbors, Overlap: options.Overlap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resultTexts(results); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: results %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	s := NewJSONStore(filepath.Join(t.TempDir(), "store.json"), JSONOptions{Retention: RetentionOptions{KeepVersions: 2}})
+	add := func(text string) {
+		t.Helper()
+		if _, err := s.AddDocument(ctx, "", "doc", text, nil, AddOptions{ChunkSize: 100}, testEmbeddings); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions := func() []int {
+		t.Helper()
+		infos, err := s.ListVersions(ctx, "", "doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var numbers []int
+		for _, v := range infos {
+			numbers = append(numbers, v.Version)
+		}
+		return numbers
+	}
+
+	add("one")
+	add("two")
+	add("two")
+	if got := versions(); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("after two texts versions are %v, want [1 2]", got)
+	}
+
+	if err := s.DeleteDocument(ctx, "", "doc"); err != nil {
+		t.Fatal(err)
+	}
+	add("three")
+	if got := versions(); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("after deleting and adding again versions are %v, want [1 2 3]", got)
+	}
+
+	add("four")
+	add("five")
+	if got := versions(); !slices.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("keeping 2 superseded versions leaves %v, want [3 4 5]", got)
+	}
+
+	for version, want := range map[int][]string{1: nil, 3: {"three"}, 4: {"four"}, 5: {"five"}} {
+		results, err := s.Search(ctx, "", []float32{1, 0, 0}, SearchOptions{TopK: 5, MMRLambda: 1, Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resultTexts(results); !slices.Equal(got, want) {
+			t.Errorf("search of version %d = %q, want %q", version, got, want)
+		}
+	}
+}
+
+func TestSearchAsOf(t *testing.T) {
+	ctx := context.Background()
+	s := NewJSONStore(filepath.Join(t.TempDir(), "store.json"), JSONOptions{Retention: RetentionOptions{KeepVersions: -1}})
+	before := time.Now().Add(-time.Hour)
+	if _, err := s.AddDocument(ctx, "", "doc", "old", nil, AddOptions{ChunkSize: 100}, testEmbeddings); err != nil {
+		t.Fatal(err)
+	}
+	// Versions are timestamped in seconds.
+	first := time.Now().Truncate(time.Second)
+	time.Sleep(time.Until(first.Add(1100 * time.Millisecond)))
+	if _, err := s.AddDocument(ctx, "", "doc", "new", nil, AddOptions{ChunkSize: 100}, testEmbeddings); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		asOf time.Time
+		want []string
+	}{
+		{"before the first version", before, nil},
+		{"while the first was current", first, []string{"old"}},
+		{"now", time.Now(), []string{"new"}},
+	} {
+		results, err := s.Search(ctx, "", []float32{1, 0, 0}, SearchOptions{TopK: 5, MMRLambda: 1, AsOf: tt.asOf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resultTexts(results); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: search = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func resultTexts(results []content.SearchResult) []string {
+	var texts []string
+	for _, res := range results {
+		texts = append(texts, res.Text)
+	}
+	return texts
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+const historyFileSuffix = ".history"
+
+func (s *jsonCollection) documentRecords(docID string) ([]record, error) {
+	var records []record
+	err := s.view(func() error {
+		records = s.recordsOf(docID)
+		return nil
+	})
+	return records, err
+}
+
+// recordsOf must be called within view or modify.
+func (s *jsonCollection) recordsOf(docID string) []record {
+	var records []record
+	for _, r := range s.records {
+		if r.DocID == docID {
+			records = append(records, r.detach())
+		}
+	}
+	return records
+}
+
+func (s *jsonCollection) nextVersion(docID string, current []record) (int, error) {
+	latest := 0
+	archived, err := s.history.documentRecords(docID)
+	for _, r := range append(archived, current...) {
+		latest = max(latest, r.version())
+	}
+	return latest + 1, err
+}
+
+// archive runs after the collection has logged the change, so a failed write
+// never leaves a version both current and archived.
+func (s *jsonCollection) archive(docID string, current []record, now time.Time) error {
+	if len(current) == 0 || s.retention.KeepVersions == 0 {
+		return nil
+	}
+	return s.history.modify(func() []walEntry {
+		latest := 0
+		var archived []record
+		for _, r := range s.history.records {
+			if r.DocID == docID {
+				archived = append(archived, r)
+			}
+		}
+		for _, r := range current {
+			r.ReplacedAt = now.Unix()
+			archived = append(archived, r)
+		}
+		for _, r := range archived {
+			latest = max(latest, r.version())
+		}
+
+		kept := slices.DeleteFunc(archived, func(r record) bool {
+			return !s.retention.keeps(r.version(), latest, r.replacedAt(), now)
+		})
+		return []walEntry{{Op: walOpAdd, DocID: docID, Records: kept}}
+	})
+}
+
+func (s *jsonCollection) archived(options SearchOptions) ([]record, error) {
+	if !options.versioned() {
+		return nil, nil
+	}
+
+	var records []record
+	err := s.history.view(func() error {
+		for _, r := range s.history.records {
+			if options.selects(r.version(), time.Unix(r.CreatedAt, 0), r.replacedAt()) {
+				records = append(records, r.detach())
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// selectRecords must be called within view.
+func (s *jsonCollection) selectRecords(archived []record, options SearchOptions) []record {
+	if !options.versioned() {
+		return s.records
+	}
+
+	records := slices.Clip(archived)
+	for _, r := range s.records {
+		if options.selects(r.version(), time.Unix(r.CreatedAt, 0), time.Time{}) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+func (s *jsonCollection) ListVersions(ctx context.Context, docID string) ([]VersionInfo, error) {
+	archived, err := s.history.documentRecords(docID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.documentRecords(docID)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []VersionInfo
+	index := make(map[int]int)
+	for _, r := range append(archived, current...) {
+		if i, ok := index[r.version()]; ok {
+			versions[i].ChunkCount++
+			continue
+		}
+		index[r.version()] = len(versions)
+		versions = append(versions, VersionInfo{
+			Version:    r.version(),
+			Hash:       r.Hash,
+			Metadata:   r.Metadata,
+			ChunkCount: 1,
+			CreatedAt:  time.Unix(r.CreatedAt, 0).In(jst),
+			ReplacedAt: r.replacedAt(),
+		})
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+
+	sortVersions(versions)
+	return versions, nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// Memory mapping is only implemented on unix; elsewhere the file is read
+// into memory.
+func mapFile(path string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
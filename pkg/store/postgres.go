@@ -4,27 +4,43 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"slices"
+	"regexp"
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pgvector/pgvector-go"
 	"github.com/tik-choco-lab/rag/pkg/content"
 )
 
 const (
 	recencySampleMultiplier = 2
+	mmrSampleMultiplier     = 4
 	sqlParamStartIndex      = 2
+	collectionsTableSuffix  = "_collections"
+	maxIdentifierLength     = 63
+
+	// maxTableLength leaves room for the longest derived name, so derivedName
+	// never shortens a table into a prefix another table shares.
+	maxTableLength = maxIdentifierLength - len(embeddingIndexSuffix)
 )
 
+var tableNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
 type pgStore struct {
 	db        *sql.DB
 	tableName string
+	index     IndexOptions
+	retention RetentionOptions
 }
 
-func NewPostgresStore(connStr string, tableName string) (Store, error) {
+func NewPostgresStore(connStr string, tableName string, options PostgresOptions) (Store, error) {
+	if !tableNamePattern.MatchString(tableName) || len(tableName) > maxTableLength {
+		return nil, fmt.Errorf("invalid table name %q: use at most %d lowercase letters, digits and underscores", tableName, maxTableLength)
+	}
+
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
@@ -37,6 +53,8 @@ func NewPostgresStore(connStr string, tableName string) (Store, error) {
 	s := &pgStore{
 		db:        db,
 		tableName: tableName,
+		index:     options.Index,
+		retention: options.Retention,
 	}
 	if err := s.init(); err != nil {
 		return nil, err
@@ -45,49 +63,413 @@ func NewPostgresStore(connStr string, tableName string) (Store, error) {
 	return s, nil
 }
 
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
 func (s *pgStore) init() error {
-	_, err := s.db.Exec(`CREATE EXTENSION IF NOT EXISTS vector`)
+	ctx := context.Background()
+	_, err := s.db.ExecContext(ctx, `CREATE EXTENSION IF NOT EXISTS vector`)
 	if err != nil {
 		return err
 	}
 
 	query := fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS %s (
-			id SERIAL PRIMARY KEY,
-			doc_id TEXT,
-			hash TEXT,
-			content TEXT,
-			embedding vector,
-			metadata JSONB,
+			name TEXT PRIMARY KEY,
+			table_name TEXT NOT NULL UNIQUE,
+			embedding_model TEXT NOT NULL DEFAULT '',
+			dimension INTEGER NOT NULL DEFAULT 0,
 			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 		)
-	`, s.tableName)
-	_, err = s.db.Exec(query)
+	`, s.registryTable())
+	if _, err = s.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	query = fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS ttl_seconds BIGINT NOT NULL DEFAULT 0", s.registryTable())
+	if _, err = s.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	return s.initSchema(ctx)
+}
+
+func vectorType(dim int) string {
+	if dim > 0 {
+		return fmt.Sprintf("vector(%d)", dim)
+	}
+	return "vector"
+}
+
+func (s *pgStore) registryTable() string {
+	return pq.QuoteIdentifier(s.tableName + collectionsTableSuffix)
+}
+
+// The default collection always lives in the configured table.
+func (s *pgStore) collection(ctx context.Context, name string, create bool) (Collection, string, error) {
+	name, err := collectionName(name)
+	if err != nil {
+		return Collection{}, "", err
+	}
+
+	info, table, err := s.describe(ctx, name)
+	if errors.Is(err, ErrCollectionNotFound) && create {
+		err = s.CreateCollection(ctx, Collection{Name: name})
+		if err == nil || errors.Is(err, ErrCollectionExists) {
+			info, table, err = s.describe(ctx, name)
+		}
+	}
+	return info, table, err
+}
+
+func (s *pgStore) describe(ctx context.Context, name string) (Collection, string, error) {
+	info := Collection{Name: name}
+	var table string
+	var ttl int64
+	query := fmt.Sprintf("SELECT table_name, embedding_model, dimension, created_at, ttl_seconds FROM %s WHERE name = $1", s.registryTable())
+	err := s.db.QueryRowContext(ctx, query, name).Scan(&table, &info.EmbeddingModel, &info.Dimension, &info.CreatedAt, &ttl)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && name == DefaultCollection:
+		return info, s.tableName, nil
+	case errors.Is(err, sql.ErrNoRows):
+		return Collection{}, "", ErrCollectionNotFound
+	case err != nil:
+		return Collection{}, "", err
+	}
+	info.CreatedAt = info.CreatedAt.In(jst)
+	info.TTL = time.Duration(ttl) * time.Second
+	return info, table, nil
+}
+
+func (s *pgStore) bindEmbedding(ctx context.Context, info Collection, table string, model string, dim int) error {
+	if changed, err := info.bindEmbedding(model, dim); err != nil || !changed {
+		return err
+	}
+
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	query := fmt.Sprintf(`
+		INSERT INTO %s (name, table_name, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO NOTHING
+	`, s.registryTable())
+	if _, err := txn.ExecContext(ctx, query, info.Name, table, time.Now().In(jst)); err != nil {
+		return err
+	}
+
+	current := Collection{Name: info.Name}
+	query = fmt.Sprintf("SELECT embedding_model, dimension FROM %s WHERE name = $1 FOR UPDATE", s.registryTable())
+	if err := txn.QueryRowContext(ctx, query, info.Name).Scan(&current.EmbeddingModel, &current.Dimension); err != nil {
+		return err
+	}
+	if _, err := current.bindEmbedding(model, dim); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("UPDATE %s SET embedding_model = $2, dimension = $3 WHERE name = $1", s.registryTable())
+	if _, err := txn.ExecContext(ctx, query, info.Name, current.EmbeddingModel, current.Dimension); err != nil {
+		return err
+	}
+	if err := s.migrate(ctx, txn, table, current.Dimension); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (s *pgStore) tableFor(name string) string {
+	if name == DefaultCollection {
+		return s.tableName
+	}
+	return s.tableName + "_" + name
+}
+
+func (s *pgStore) CreateCollection(ctx context.Context, collection Collection) error {
+	name, err := collectionName(collection.Name)
+	if err != nil {
+		return err
+	}
+	if collection.CreatedAt.IsZero() {
+		collection.CreatedAt = time.Now().In(jst)
+	}
+
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	table, err := s.freeTable(ctx, txn, name)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`
+		INSERT INTO %s (name, table_name, embedding_model, dimension, created_at, ttl_seconds)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (name) DO NOTHING
+	`, s.registryTable())
+	res, err := txn.ExecContext(ctx, query, name, table, collection.EmbeddingModel, collection.Dimension, collection.CreatedAt, int64(collection.TTL/time.Second))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCollectionExists
+	}
+
+	if err := s.migrate(ctx, txn, table, collection.Dimension); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (s *pgStore) ListCollections(ctx context.Context) ([]Collection, error) {
+	query := fmt.Sprintf("SELECT name, embedding_model, dimension, created_at, ttl_seconds FROM %s ORDER BY name", s.registryTable())
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collections []Collection
+	for rows.Next() {
+		var c Collection
+		var ttl int64
+		if err := rows.Scan(&c.Name, &c.EmbeddingModel, &c.Dimension, &c.CreatedAt, &ttl); err != nil {
+			return nil, err
+		}
+		c.CreatedAt = c.CreatedAt.In(jst)
+		c.TTL = time.Duration(ttl) * time.Second
+		collections = append(collections, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return withDefault(collections), nil
+}
+
+func (s *pgStore) DropCollection(ctx context.Context, name string) error {
+	name, err := collectionName(name)
+	if err != nil {
+		return err
+	}
+
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	var table string
+	query := fmt.Sprintf("DELETE FROM %s WHERE name = $1 RETURNING table_name", s.registryTable())
+	err = txn.QueryRowContext(ctx, query, name).Scan(&table)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && name == DefaultCollection:
+		table = s.tableName
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrCollectionNotFound
+	case err != nil:
+		return err
+	}
+
+	if err := s.dropTable(ctx, txn, table); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (s *pgStore) SwapCollection(ctx context.Context, collection string, shadow string) error {
+	name, err := collectionName(collection)
+	if err != nil {
+		return err
+	}
+	if shadow, err = collectionName(shadow); err != nil {
+		return err
+	}
+
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	next := Collection{Name: shadow}
+	var nextTable string
+	query := fmt.Sprintf("DELETE FROM %s WHERE name = $1 RETURNING table_name, embedding_model, dimension", s.registryTable())
+	err = txn.QueryRowContext(ctx, query, shadow).Scan(&nextTable, &next.EmbeddingModel, &next.Dimension)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCollectionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(`
+		INSERT INTO %s (name, table_name, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO NOTHING
+	`, s.registryTable())
+	if name == DefaultCollection {
+		if _, err := txn.ExecContext(ctx, query, name, s.tableName, time.Now().In(jst)); err != nil {
+			return err
+		}
+	}
+
+	var table string
+	query = fmt.Sprintf("SELECT table_name FROM %s WHERE name = $1 FOR UPDATE", s.registryTable())
+	err = txn.QueryRowContext(ctx, query, name).Scan(&table)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCollectionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("UPDATE %s SET table_name = $2, embedding_model = $3, dimension = $4 WHERE name = $1", s.registryTable())
+	if _, err := txn.ExecContext(ctx, query, name, nextTable, next.EmbeddingModel, next.Dimension); err != nil {
+		return err
+	}
+	if err := s.dropTable(ctx, txn, table); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// dropTable only empties the configured table, which the default collection
+// falls back to.
+func (s *pgStore) dropTable(ctx context.Context, db execer, table string) error {
+	if table == s.tableName {
+		_, err := db.ExecContext(ctx, fmt.Sprintf("TRUNCATE %s, %s", pq.QuoteIdentifier(table), pq.QuoteIdentifier(historyTable(table))))
+		return err
+	}
+
+	query := fmt.Sprintf("DROP TABLE IF EXISTS %s, %s", pq.QuoteIdentifier(table), pq.QuoteIdentifier(historyTable(table)))
+	if _, err := db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	query = fmt.Sprintf("DELETE FROM %s WHERE table_name = $1", s.schemaTable())
+	_, err := db.ExecContext(ctx, query, table)
 	return err
 }
 
-func (s *pgStore) AddDocument(ctx context.Context, docID string, text string, metadata map[string]string, chunkSize, overlap int, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) error {
-	cleanText := content.CleanText(text)
-	newHash := content.CalculateHash(cleanText)
+// freeTable numbers the table when a swapped collection already uses the name.
+func (s *pgStore) freeTable(ctx context.Context, txn *sql.Tx, name string) (string, error) {
+	if name == DefaultCollection {
+		return s.tableName, nil
+	}
 
-	var existingID int
-	query := fmt.Sprintf("SELECT id FROM %s WHERE doc_id = $1 AND hash = $2 LIMIT 1", s.tableName)
-	err := s.db.QueryRowContext(ctx, query, docID, newHash).Scan(&existingID)
-	if err == nil {
-		return nil
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE table_name = $1)", s.registryTable())
+	table := s.tableFor(name)
+	for n := 2; ; n++ {
+		if len(table) > maxTableLength {
+			return "", fmt.Errorf("table name %q for collection %q exceeds %d characters", table, name, maxTableLength)
+		}
+		var used bool
+		if err := txn.QueryRowContext(ctx, query, table).Scan(&used); err != nil {
+			return "", err
+		}
+		if !used && !strings.HasSuffix(table, historyTableSuffix) {
+			return table, nil
+		}
+		table = fmt.Sprintf("%s_%d", s.tableFor(name), n)
 	}
+}
+
+func (s *pgStore) AddDocument(ctx context.Context, collection string, docID string, text string, metadata map[string]string, options AddOptions, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) (AddResult, error) {
+	return s.AddChunks(ctx, collection, newDocument(docID, text, metadata, options), options, embeddingsFunc)
+}
 
-	if err := s.DeleteDocument(ctx, docID); err != nil {
+func (s *pgStore) AddChunks(ctx context.Context, collection string, doc Document, options AddOptions, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) (AddResult, error) {
+	info, table, err := s.collection(ctx, collection, true)
+	if err != nil {
+		return AddResult{}, err
+	}
+	if err := info.checkEmbedding(options.EmbeddingModel, info.Dimension); err != nil {
+		return AddResult{}, err
+	}
+
+	doc = completeHashes(doc)
+	previous, same, err := s.previousChunks(ctx, table, doc.DocID, doc.Hash)
+	if err != nil {
+		return AddResult{}, err
+	}
+	if same {
+		doc.ExpiresAt = options.expiresAt(info, time.Now())
+		return AddResult{Kept: len(previous)}, s.refreshDocument(ctx, table, doc)
+	}
+
+	chunks, result, err := embedDocument(ctx, doc.Chunks, previous, options, s.duplicateSource(info, table, doc.DocID), embeddingsFunc)
+	if err != nil {
+		return AddResult{}, err
+	}
+	dim, err := embeddingDimension(chunkEmbeddings(chunks))
+	if err != nil {
+		return AddResult{}, err
+	}
+	if err := s.bindEmbedding(ctx, info, table, options.EmbeddingModel, dim); err != nil {
+		return AddResult{}, err
+	}
+
+	now := time.Now().In(jst)
+	doc.CreatedAt = now
+	doc.ExpiresAt = options.expiresAt(info, now)
+	doc.Chunks = chunks
+	return result, s.insertDocument(ctx, table, doc, true)
+}
+
+func (s *pgStore) previousChunks(ctx context.Context, table, docID, hash string) ([]Chunk, bool, error) {
+	query := fmt.Sprintf("SELECT hash, chunk_hash, content, embedding FROM %s WHERE doc_id = $1", pq.QuoteIdentifier(table))
+	rows, err := s.db.QueryContext(ctx, query, docID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var chunks []Chunk
+	same := false
+	for rows.Next() {
+		var c Chunk
+		var docHash string
+		var vec pgvector.Vector
+		if err := rows.Scan(&docHash, &c.Hash, &c.Text, &vec); err != nil {
+			return nil, false, err
+		}
+		c.Embedding = vec.Slice()
+		chunks = append(chunks, c)
+		same = same || docHash == hash
+	}
+	return chunks, same, rows.Err()
+}
+
+func (s *pgStore) PutDocument(ctx context.Context, collection string, doc Document) error {
+	info, table, err := s.collection(ctx, collection, true)
+	if err != nil {
 		return err
 	}
 
-	chunks := content.SplitText(cleanText, chunkSize, overlap)
-	embeddings, err := embeddingsFunc(ctx, chunks)
+	dim, err := embeddingDimension(chunkEmbeddings(doc.Chunks))
 	if err != nil {
 		return err
 	}
+	if err := s.bindEmbedding(ctx, info, table, "", dim); err != nil {
+		return err
+	}
+	return s.insertDocument(ctx, table, doc, false)
+}
 
-	metaJSON, err := json.Marshal(metadata)
+// insertDocument replaces the rows of doc.DocID in one transaction under an
+// advisory lock on the document. With add it archives the stored version
+// unless another writer already stored the same content.
+func (s *pgStore) insertDocument(ctx context.Context, table string, doc Document, add bool) error {
+	metaJSON, err := json.Marshal(doc.Metadata)
 	if err != nil {
 		return err
 	}
@@ -98,144 +480,507 @@ func (s *pgStore) AddDocument(ctx context.Context, docID string, text string, me
 	}
 	defer txn.Rollback()
 
-	for i, chunk := range chunks {
-		query := fmt.Sprintf("INSERT INTO %s (doc_id, hash, content, embedding, metadata, created_at) VALUES ($1, $2, $3, $4, $5, $6)", s.tableName)
-		_, err = txn.ExecContext(ctx, query,
-			docID, newHash, chunk, pgvector.NewVector(embeddings[i]), metaJSON, time.Now().In(jst),
+	if err := s.lockDocument(ctx, txn, table, doc.DocID); err != nil {
+		return err
+	}
+	doc.Version = max(doc.Version, 1)
+	if add {
+		exists, err := s.hasDocument(ctx, txn, table, doc.DocID, doc.Hash)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := s.refreshRows(ctx, txn, table, doc); err != nil {
+				return err
+			}
+			return txn.Commit()
+		}
+		if doc.Version, err = s.archive(ctx, txn, table, doc.DocID, doc.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE doc_id = $1", pq.QuoteIdentifier(table))
+	if _, err := txn.ExecContext(ctx, query, doc.DocID); err != nil {
+		return err
+	}
+
+	expiresAt := sql.NullTime{Time: doc.ExpiresAt, Valid: !doc.ExpiresAt.IsZero()}
+	stmt, err := txn.PrepareContext(ctx, pq.CopyIn(table, "doc_id", "chunk_index", "hash", "content", "embedding", "metadata", "created_at", "parent_index", "parent_content", "chunk_hash", "version", "expires_at", "signature", "bands", "duplicate_of", "duplicate_index", "weight"))
+	if err != nil {
+		return err
+	}
+	for _, chunk := range doc.Chunks {
+		_, err = stmt.ExecContext(ctx,
+			doc.DocID, chunk.Index, doc.Hash, chunk.Text, pgvector.NewVector(content.Normalize(chunk.Embedding)), string(metaJSON), doc.CreatedAt, chunk.ParentIndex, chunk.ParentText, chunk.Hash, doc.Version, expiresAt,
+			signatureArray(chunk.Signature), signatureArray(signatureBands(chunk.Signature)), chunk.DuplicateOf.DocID, chunk.DuplicateOf.Index, chunk.weight(),
 		)
 		if err != nil {
+			stmt.Close()
 			return err
 		}
 	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+func (s *pgStore) refreshDocument(ctx context.Context, table string, doc Document) error {
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
 
+	if err := s.lockDocument(ctx, txn, table, doc.DocID); err != nil {
+		return err
+	}
+	if err := s.refreshRows(ctx, txn, table, doc); err != nil {
+		return err
+	}
 	return txn.Commit()
 }
 
-func (s *pgStore) Search(ctx context.Context, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
-	where, args := s.buildWhere(options.Metadata)
+// refreshRows updates metadata and expiry of the rows that still hold doc.Hash.
+func (s *pgStore) refreshRows(ctx context.Context, db execer, table string, doc Document) error {
+	metaJSON, err := json.Marshal(doc.Metadata)
+	if err != nil {
+		return err
+	}
 	query := fmt.Sprintf(`
-		SELECT content, 1 - (embedding <=> $1) as score
+		UPDATE %s SET metadata = $3::jsonb, expires_at = $4
+		WHERE doc_id = $1 AND hash = $2 AND (metadata IS DISTINCT FROM $3::jsonb OR expires_at IS DISTINCT FROM $4)
+	`, pq.QuoteIdentifier(table))
+	expiresAt := sql.NullTime{Time: doc.ExpiresAt, Valid: !doc.ExpiresAt.IsZero()}
+	_, err = db.ExecContext(ctx, query, doc.DocID, doc.Hash, string(metaJSON), expiresAt)
+	return err
+}
+
+func (s *pgStore) lockDocument(ctx context.Context, txn *sql.Tx, table, docID string) error {
+	_, err := txn.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", table+"/"+docID)
+	return err
+}
+
+func (s *pgStore) hasDocument(ctx context.Context, q querier, table, docID, hash string) (bool, error) {
+	query := fmt.Sprintf("SELECT 1 FROM %s WHERE doc_id = $1 AND hash = $2 LIMIT 1", pq.QuoteIdentifier(table))
+	rows, err := q.QueryContext(ctx, query, docID, hash)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+func (s *pgStore) Search(ctx context.Context, collection string, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	info, table, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := info.checkEmbedding(options.EmbeddingModel, len(queryEmbedding)); err != nil {
+		return nil, err
+	}
+
+	limit := options.sampleSize()
+	if options.MMRLambda < 1.0 {
+		limit *= mmrSampleMultiplier
+	}
+
+	cands, err := s.candidates(ctx, table, queryEmbedding, options, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := make([]content.Ranked, len(cands))
+	embeddings := make([][]float32, len(cands))
+	for i, c := range cands {
+		ranked[i] = content.Ranked{Index: i, Score: c.hit.result.Score}
+		embeddings[i] = c.embedding
+	}
+
+	return s.finish(ctx, table, cands, content.SelectMMR(ranked, embeddings, options.sampleSize(), options.MMRLambda), options)
+}
+
+func (s *pgStore) RecencySearch(ctx context.Context, collection string, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	info, table, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := info.checkEmbedding(options.EmbeddingModel, len(queryEmbedding)); err != nil {
+		return nil, err
+	}
+
+	limit := options.sampleSize() * recencySampleMultiplier
+	if options.MMRLambda < 1.0 {
+		limit *= mmrSampleMultiplier
+	}
+
+	cands, err := s.candidates(ctx, table, queryEmbedding, options, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	now := options.Recency.now()
+	ranked := make([]content.Ranked, len(cands))
+	embeddings := make([][]float32, len(cands))
+	for i, c := range cands {
+		timeScore := options.Recency.score(now, c.createdAt, c.hit.result.Metadata)
+		ranked[i] = content.Ranked{
+			Index: i,
+			Score: blendRecency(c.hit.result.Score, timeScore, options.RecencyWeight),
+		}
+		embeddings[i] = c.embedding
+	}
+
+	return s.finish(ctx, table, cands, content.SelectMMR(ranked, embeddings, options.sampleSize(), options.MMRLambda), options)
+}
+
+type pgCandidate struct {
+	hit       hit
+	embedding []float32
+	createdAt time.Time
+}
+
+func (s *pgStore) candidates(ctx context.Context, table string, queryEmbedding []float32, options SearchOptions, limit int) ([]pgCandidate, error) {
+	where, args := s.buildWhere(options.Metadata, sqlParamStartIndex)
+	source, where, args := s.searchSource(table, options, where, args, sqlParamStartIndex)
+	query := fmt.Sprintf(`
+		SELECT doc_id, chunk_index, parent_index, content, metadata, embedding, created_at, duplicate_of, duplicate_index, weight, 1 - (embedding <=> $1) as score
 		FROM %s
-		%%s
+		%s
 		ORDER BY embedding <=> $1
-		LIMIT %%d
-	`, s.tableName)
-	query = fmt.Sprintf(query, where, options.TopK)
+		LIMIT $%d
+	`, source, where, sqlParamStartIndex+len(args))
+	args = append(args, limit)
 
-	fullArgs := append([]interface{}{pgvector.NewVector(queryEmbedding)}, args...)
+	var q querier = s.db
+	if settings := s.index.searchSettings(); len(settings) > 0 {
+		txn, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+		if err != nil {
+			return nil, err
+		}
+		defer txn.Rollback()
+		for _, stmt := range settings {
+			if _, err := txn.ExecContext(ctx, stmt); err != nil {
+				return nil, err
+			}
+		}
+		q = txn
+	}
 
-	rows, err := s.db.QueryContext(ctx, query, fullArgs...)
+	fullArgs := append([]interface{}{pgvector.NewVector(queryEmbedding)}, args...)
+	rows, err := q.QueryContext(ctx, query, fullArgs...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var results []content.SearchResult
+	var cands []pgCandidate
 	for rows.Next() {
-		var res content.SearchResult
-		if err := rows.Scan(&res.Text, &res.Score); err != nil {
+		var c pgCandidate
+		var metaJSON []byte
+		var vec pgvector.Vector
+		var weight float32
+		res := &c.hit.result
+		dup := &c.hit.duplicateOf
+		if err := rows.Scan(&res.DocID, &res.ChunkIndex, &res.ParentIndex, &res.Text, &metaJSON, &vec, &c.createdAt, &dup.DocID, &dup.Index, &weight, &res.Score); err != nil {
 			return nil, err
 		}
-		if res.Score >= options.Threshold {
-			results = append(results, res)
+		if res.Score < options.Threshold {
+			continue
+		}
+		res.Score *= weight
+		if res.Metadata, err = decodeMetadata(metaJSON); err != nil {
+			return nil, err
 		}
+		c.embedding = content.Normalize(vec.Slice())
+		cands = append(cands, c)
 	}
+	return cands, rows.Err()
+}
 
-	return results, nil
+func (s *pgStore) finish(ctx context.Context, table string, cands []pgCandidate, ranked []content.Ranked, options SearchOptions) ([]content.SearchResult, error) {
+	hits := make([]hit, len(ranked))
+	for i, rk := range ranked {
+		hits[i] = cands[rk.Index].hit
+		hits[i].result.Score = rk.Score
+	}
+	results, err := collectResults(ctx, hits, options, s.parentText(table, options))
+	if err != nil {
+		return nil, err
+	}
+	return expandNeighbors(ctx, results, options, s.chunkRange(table, options))
 }
 
-func (s *pgStore) RecencySearch(ctx context.Context, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error) {
-	where, args := s.buildWhere(options.Metadata)
-	query := fmt.Sprintf(`
-		SELECT content, 1 - (embedding <=> $1) as score, created_at
-		FROM %s
-		%%s
-		ORDER BY embedding <=> $1
-		LIMIT %%d
-	`, s.tableName)
-	query = fmt.Sprintf(query, where, options.TopK*recencySampleMultiplier)
+func (s *pgStore) DeleteDocument(ctx context.Context, collection string, docID string) error {
+	_, table, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return err
+	}
 
-	fullArgs := append([]interface{}{pgvector.NewVector(queryEmbedding)}, args...)
-	rows, err := s.db.QueryContext(ctx, query, fullArgs...)
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := s.lockDocument(ctx, txn, table, docID); err != nil {
+		return err
+	}
+	if _, err := s.archive(ctx, txn, table, docID, time.Now().In(jst)); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE doc_id = $1", pq.QuoteIdentifier(table))
+	if _, err := txn.ExecContext(ctx, query, docID); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func (s *pgStore) ListDocuments(ctx context.Context, collection string, options ListOptions) ([]DocumentInfo, error) {
+	_, table, err := s.collection(ctx, collection, false)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	type intermediate struct {
-		res content.SearchResult
-		ts  time.Time
+	where, args := s.buildWhere(options.Metadata, 1)
+	n := len(args)
+
+	var limit sql.NullInt64
+	if options.Limit > 0 {
+		limit = sql.NullInt64{Int64: int64(options.Limit), Valid: true}
 	}
 
-	var samples []intermediate
-	var maxTS, minTS int64
+	query := fmt.Sprintf(`
+		SELECT doc_id, MAX(version), MIN(hash), (ARRAY_AGG(metadata))[1], COUNT(*), MIN(created_at), MAX(expires_at)
+		FROM %s
+		%s
+		GROUP BY doc_id
+		ORDER BY doc_id
+		LIMIT $%d OFFSET $%d
+	`, pq.QuoteIdentifier(table), where, n+1, n+2)
+	args = append(args, limit, max(options.Offset, 0))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	var docs []DocumentInfo
 	for rows.Next() {
-		var item intermediate
-		if err := rows.Scan(&item.res.Text, &item.res.Score, &item.ts); err != nil {
+		var info DocumentInfo
+		var metaJSON []byte
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&info.DocID, &info.Version, &info.Hash, &metaJSON, &info.ChunkCount, &info.CreatedAt, &expiresAt); err != nil {
 			return nil, err
 		}
-		if item.res.Score < options.Threshold {
-			continue
+		info.ExpiresAt = localTime(expiresAt)
+		if info.Metadata, err = decodeMetadata(metaJSON); err != nil {
+			return nil, err
 		}
-		samples = append(samples, item)
-		ts := item.ts.Unix()
-		if ts > maxTS {
-			maxTS = ts
+		info.CreatedAt = info.CreatedAt.In(jst)
+		info.Date = info.CreatedAt.Format(time.RFC3339)
+		docs = append(docs, info)
+	}
+	return docs, rows.Err()
+}
+
+func (s *pgStore) GetDocument(ctx context.Context, collection string, docID string) (*Document, error) {
+	_, table, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT chunk_index, chunk_hash, content, parent_index, parent_content, embedding, signature, duplicate_of, duplicate_index, weight, version, hash, metadata, created_at, expires_at
+		FROM %s
+		WHERE doc_id = $1 AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY chunk_index
+	`, pq.QuoteIdentifier(table))
+	rows, err := s.db.QueryContext(ctx, query, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	doc := &Document{DocumentInfo: DocumentInfo{DocID: docID}}
+	var expiresAt sql.NullTime
+	for rows.Next() {
+		var c Chunk
+		var vec pgvector.Vector
+		var metaJSON []byte
+		var signature pq.Int64Array
+		if err := rows.Scan(&c.Index, &c.Hash, &c.Text, &c.ParentIndex, &c.ParentText, &vec, &signature, &c.DuplicateOf.DocID, &c.DuplicateOf.Index, &c.Weight, &doc.Version, &doc.Hash, &metaJSON, &doc.CreatedAt, &expiresAt); err != nil {
+			return nil, err
 		}
-		if minTS == 0 || ts < minTS {
-			minTS = ts
+		c.Signature = signatureSlice(signature)
+		if doc.Metadata, err = decodeMetadata(metaJSON); err != nil {
+			return nil, err
 		}
+		c.Embedding = vec.Slice()
+		doc.Chunks = append(doc.Chunks, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(doc.Chunks) == 0 {
+		return nil, ErrNotFound
 	}
 
-	for i := range samples {
-		timeScore := float32(0)
-		if maxTS != minTS {
-			timeScore = float32(samples[i].ts.Unix()-minTS) / float32(maxTS-minTS)
-		}
-		samples[i].res.Score = (1.0-options.RecencyWeight)*samples[i].res.Score + options.RecencyWeight*timeScore
+	doc.ChunkCount = len(doc.Chunks)
+	doc.CreatedAt = doc.CreatedAt.In(jst)
+	doc.ExpiresAt = localTime(expiresAt)
+	doc.Date = doc.CreatedAt.Format(time.RFC3339)
+	return doc, nil
+}
+
+func (s *pgStore) UpdateMetadata(ctx context.Context, collection string, docID string, metadata map[string]string) error {
+	_, table, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return err
 	}
 
-	var finalResults []content.SearchResult
-	for _, s := range samples {
-		finalResults = append(finalResults, s.res)
+	metaJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return err
 	}
 
-	slices.SortFunc(finalResults, func(a, b content.SearchResult) int {
-		if a.Score > b.Score {
-			return -1
-		}
-		if a.Score < b.Score {
-			return 1
+	query := fmt.Sprintf("UPDATE %s SET metadata = $2 WHERE doc_id = $1", pq.QuoteIdentifier(table))
+	res, err := s.db.ExecContext(ctx, query, docID, metaJSON)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) CountChunks(ctx context.Context, collection string, metadata map[string]string) (int, error) {
+	_, table, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return 0, err
+	}
+
+	where, args := s.buildWhere(metadata, 1)
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s %s", pq.QuoteIdentifier(table), where)
+
+	var n int
+	err = s.db.QueryRowContext(ctx, query, args...).Scan(&n)
+	return n, err
+}
+
+func (s *pgStore) parentText(table string, options SearchOptions) parentTextFunc {
+	return func(ctx context.Context, docID string, parentIndex int) (string, error) {
+		args := []interface{}{docID, parentIndex}
+		source, where, args := s.searchSource(table, options, "WHERE doc_id = $1 AND parent_index = $2 AND parent_content <> ''", args, 1)
+		query := fmt.Sprintf("SELECT parent_content FROM %s %s LIMIT 1", source, where)
+
+		var text string
+		err := s.db.QueryRowContext(ctx, query, args...).Scan(&text)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
 		}
-		return 0
-	})
+		return text, err
+	}
+}
 
-	if len(finalResults) > options.TopK {
-		return finalResults[:options.TopK], nil
+// At most one version of a document matches a time or number.
+func (s *pgStore) chunkRange(table string, options SearchOptions) chunkRangeFunc {
+	return func(ctx context.Context, docID string, from, to int) ([]Chunk, error) {
+		args := []interface{}{docID, from, to}
+		source, where, args := s.searchSource(table, options, "WHERE doc_id = $1 AND chunk_index BETWEEN $2 AND $3", args, 1)
+		query := fmt.Sprintf("SELECT chunk_index, parent_index, content FROM %s %s ORDER BY chunk_index", source, where)
+		rows, err := s.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var chunks []Chunk
+		for rows.Next() {
+			var c Chunk
+			if err := rows.Scan(&c.Index, &c.ParentIndex, &c.Text); err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, c)
+		}
+		return chunks, rows.Err()
 	}
-	return finalResults, nil
 }
 
-func (s *pgStore) DeleteDocument(ctx context.Context, docID string) error {
-	query := fmt.Sprintf("DELETE FROM %s WHERE doc_id = $1", s.tableName)
-	_, err := s.db.ExecContext(ctx, query, docID)
-	return err
+func decodeMetadata(data []byte) (map[string]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
 }
 
-func (s *pgStore) buildWhere(metadata map[string]string) (string, []interface{}) {
+// Containment can be served by the GIN index on metadata.
+func (s *pgStore) buildWhere(metadata map[string]string, start int) (string, []interface{}) {
+	where := "WHERE (expires_at IS NULL OR expires_at > now())"
 	if len(metadata) == 0 {
-		return "", nil
+		return where, nil
+	}
+
+	filter, _ := json.Marshal(metadata)
+	return fmt.Sprintf("%s AND metadata @> $%d", where, start), []interface{}{filter}
+}
+
+func localTime(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time.In(jst)
+}
+
+func (s *pgStore) Purge(ctx context.Context, collection string) (int, error) {
+	_, table, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return 0, err
 	}
 
-	var conditions []string
-	var args []interface{}
-	i := sqlParamStartIndex
-	for k, v := range metadata {
-		conditions = append(conditions, fmt.Sprintf("metadata->>'%s' = $%d", k, i))
-		args = append(args, v)
-		i++
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
 	}
+	defer txn.Rollback()
 
-	return "WHERE " + strings.Join(conditions, " AND "), args
+	var purged int
+	query := fmt.Sprintf(`
+		WITH purged AS (DELETE FROM %s WHERE expires_at <= now() RETURNING doc_id)
+		SELECT COUNT(DISTINCT doc_id) FROM purged
+	`, pq.QuoteIdentifier(table))
+	if err := txn.QueryRowContext(ctx, query).Scan(&purged); err != nil {
+		return 0, err
+	}
+	var cutoff sql.NullTime
+	if s.retention.MaxAge > 0 {
+		cutoff = sql.NullTime{Time: time.Now().Add(-s.retention.MaxAge), Valid: true}
+	}
+	query = fmt.Sprintf("DELETE FROM %s WHERE expires_at <= now() OR replaced_at < $1", pq.QuoteIdentifier(historyTable(table)))
+	if _, err := txn.ExecContext(ctx, query, cutoff); err != nil {
+		return 0, err
+	}
+	return purged, txn.Commit()
 }
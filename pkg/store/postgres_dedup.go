@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/pgvector/pgvector-go"
+)
+
+// The GIN index on bands finds the chunks sharing a band.
+func (s *pgStore) duplicateSource(info Collection, table, docID string) duplicateSource {
+	return duplicateSource{
+		signatures: func(ctx context.Context, bands []uint64) ([]dedupCandidate, error) {
+			query := fmt.Sprintf(`
+				SELECT doc_id, chunk_index, signature, duplicate_of, duplicate_index
+				FROM %s
+				WHERE doc_id <> $1 AND bands && $2 AND (expires_at IS NULL OR expires_at > now())
+			`, pq.QuoteIdentifier(table))
+			rows, err := s.db.QueryContext(ctx, query, docID, signatureArray(bands))
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+
+			var candidates []dedupCandidate
+			for rows.Next() {
+				var c dedupCandidate
+				var signature pq.Int64Array
+				if err := rows.Scan(&c.ref.DocID, &c.ref.Index, &signature, &c.duplicateOf.DocID, &c.duplicateOf.Index); err != nil {
+					return nil, err
+				}
+				c.signature = signatureSlice(signature)
+				candidates = append(candidates, c)
+			}
+			return candidates, rows.Err()
+		},
+		nearest: func(ctx context.Context, embedding []float32) (ChunkRef, float32, error) {
+			// A chunk of another dimension cannot be compared; binding the
+			// embeddings reports the mismatch.
+			if info.Dimension > 0 && len(embedding) != info.Dimension {
+				return ChunkRef{}, 0, nil
+			}
+			query := fmt.Sprintf(`
+				SELECT doc_id, chunk_index, duplicate_of, duplicate_index, 1 - (embedding <=> $1)
+				FROM %s
+				WHERE doc_id <> $2 AND (expires_at IS NULL OR expires_at > now())
+				ORDER BY embedding <=> $1
+				LIMIT 1
+			`, pq.QuoteIdentifier(table))
+			var c dedupCandidate
+			var score float32
+			err := s.db.QueryRowContext(ctx, query, pgvector.NewVector(embedding), docID).Scan(&c.ref.DocID, &c.ref.Index, &c.duplicateOf.DocID, &c.duplicateOf.Index, &score)
+			if errors.Is(err, sql.ErrNoRows) {
+				return ChunkRef{}, 0, nil
+			}
+			return c.original(), score, err
+		},
+	}
+}
+
+func (s *pgStore) LinkDuplicates(ctx context.Context, collection string, docID string, chunks []Chunk, options DedupOptions) error {
+	if err := options.validate(); err != nil || options.Method == DedupNone {
+		return err
+	}
+	info, table, err := s.collection(ctx, collection, false)
+	if errors.Is(err, ErrCollectionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return linkDuplicates(ctx, chunks, options, s.duplicateSource(info, table, docID))
+}
+
+// signatureArray stores the unsigned hashes of a signature bit for bit in a
+// BIGINT array.
+func signatureArray(signature []uint64) pq.Int64Array {
+	if signature == nil {
+		return nil
+	}
+	a := make(pq.Int64Array, len(signature))
+	for i, h := range signature {
+		a[i] = int64(h)
+	}
+	return a
+}
+
+func signatureSlice(a pq.Int64Array) []uint64 {
+	if a == nil {
+		return nil
+	}
+	signature := make([]uint64, len(a))
+	for i, h := range a {
+		signature[i] = uint64(h)
+	}
+	return signature
+}
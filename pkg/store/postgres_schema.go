@@ -0,0 +1,367 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	schemaTableSuffix    = "_schema"
+	embeddingIndexSuffix = "_embedding_idx"
+	historyTableSuffix   = "_history"
+	bandsIndexSuffix     = "_bands_idx"
+)
+
+type IndexType string
+
+const (
+	IndexNone    IndexType = "none"
+	IndexHNSW    IndexType = "hnsw"
+	IndexIVFFlat IndexType = "ivfflat"
+
+	defaultHNSWM              = 16
+	defaultHNSWEFConstruction = 64
+	defaultIVFFlatLists       = 100
+)
+
+// EFSearch and Probes are applied to every search query.
+type IndexOptions struct {
+	Type           IndexType
+	M              int
+	EFConstruction int
+	Lists          int
+	EFSearch       int
+	Probes         int
+}
+
+type PostgresOptions struct {
+	Index     IndexOptions
+	Retention RetentionOptions
+}
+
+// migrations each bump the schema version of every data table. The first two
+// match the columns created before versioning, so old tables start at 0.
+var migrations = []func(table string, dim int) []string{
+	func(table string, dim int) []string {
+		table = pq.QuoteIdentifier(table)
+		return []string{fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				id SERIAL PRIMARY KEY,
+				doc_id TEXT,
+				hash TEXT,
+				content TEXT,
+				embedding %s,
+				metadata JSONB,
+				created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			)
+		`, table, vectorType(dim))}
+	},
+	func(table string, dim int) []string {
+		table = pq.QuoteIdentifier(table)
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS chunk_index INTEGER NOT NULL DEFAULT 0", table),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS parent_index INTEGER NOT NULL DEFAULT 0", table),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS parent_content TEXT NOT NULL DEFAULT ''", table),
+		}
+	},
+	func(table string, dim int) []string {
+		table = pq.QuoteIdentifier(table)
+		return []string{
+			fmt.Sprintf("CREATE INDEX ON %s (doc_id, chunk_index)", table),
+			fmt.Sprintf("CREATE INDEX ON %s (hash)", table),
+			fmt.Sprintf("CREATE INDEX ON %s USING GIN (metadata)", table),
+		}
+	},
+	func(table string, dim int) []string {
+		return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS chunk_hash TEXT NOT NULL DEFAULT ''", pq.QuoteIdentifier(table))}
+	},
+	func(table string, dim int) []string {
+		history := pq.QuoteIdentifier(historyTable(table))
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1", pq.QuoteIdentifier(table)),
+			fmt.Sprintf(`
+				CREATE TABLE IF NOT EXISTS %s (
+					id SERIAL PRIMARY KEY,
+					doc_id TEXT NOT NULL,
+					version INTEGER NOT NULL,
+					chunk_index INTEGER NOT NULL,
+					hash TEXT,
+					chunk_hash TEXT NOT NULL DEFAULT '',
+					content TEXT,
+					embedding vector,
+					metadata JSONB,
+					parent_index INTEGER NOT NULL DEFAULT 0,
+					parent_content TEXT NOT NULL DEFAULT '',
+					created_at TIMESTAMP WITH TIME ZONE,
+					replaced_at TIMESTAMP WITH TIME ZONE NOT NULL
+				)
+			`, history),
+			fmt.Sprintf("CREATE INDEX ON %s (doc_id, version)", history),
+		}
+	},
+	func(table string, dim int) []string {
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE", pq.QuoteIdentifier(table)),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE", pq.QuoteIdentifier(historyTable(table))),
+			fmt.Sprintf("CREATE INDEX ON %s (expires_at) WHERE expires_at IS NOT NULL", pq.QuoteIdentifier(table)),
+		}
+	},
+	func(table string, dim int) []string {
+		stmts := []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS signature BIGINT[]", pq.QuoteIdentifier(table))}
+		for _, t := range []string{table, historyTable(table)} {
+			t = pq.QuoteIdentifier(t)
+			stmts = append(stmts,
+				fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS duplicate_of TEXT NOT NULL DEFAULT ''", t),
+				fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS duplicate_index INTEGER NOT NULL DEFAULT 0", t),
+				fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS weight REAL NOT NULL DEFAULT 1", t),
+			)
+		}
+		return stmts
+	},
+	// Keep each parent text on the first chunk of the parent only.
+	func(table string, dim int) []string {
+		var stmts []string
+		for _, t := range []string{table, historyTable(table)} {
+			stmts = append(stmts, fmt.Sprintf(`
+				UPDATE %[1]s AS c SET parent_content = ''
+				WHERE c.parent_content <> '' AND EXISTS (
+					SELECT 1 FROM %[1]s AS p
+					WHERE p.doc_id = c.doc_id AND p.version = c.version AND p.parent_index = c.parent_index
+						AND p.parent_content <> '' AND p.chunk_index < c.chunk_index
+				)
+			`, pq.QuoteIdentifier(t)))
+		}
+		return stmts
+	},
+	// Number the chunks of older rows, which all read as 0.
+	func(table string, dim int) []string {
+		var stmts []string
+		for _, t := range []string{table, historyTable(table)} {
+			stmts = append(stmts, fmt.Sprintf(`
+				UPDATE %[1]s AS c SET chunk_index = n.position
+				FROM (
+					SELECT id, ROW_NUMBER() OVER (PARTITION BY doc_id, version ORDER BY id) - 1 AS position
+					FROM %[1]s
+					WHERE (doc_id, version) IN (
+						SELECT doc_id, version FROM %[1]s
+						GROUP BY doc_id, version
+						HAVING COUNT(*) > 1 AND MAX(chunk_index) = 0
+					)
+				) AS n
+				WHERE c.id = n.id
+			`, pq.QuoteIdentifier(t)))
+		}
+		return stmts
+	},
+	// Add the locality-sensitive hashing bands of the signatures, computed
+	// as signatureBands does, so duplicate candidates are found by index.
+	func(table string, dim int) []string {
+		t := pq.QuoteIdentifier(table)
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS bands BIGINT[]", t),
+			fmt.Sprintf(`
+				UPDATE %s SET bands = ARRAY(
+					SELECT ((signature[1] >> (%[2]d * i)) & %[3]d) | (i::bigint << %[2]d)
+					FROM generate_series(0, %[4]d) AS i ORDER BY i
+				)
+				WHERE cardinality(signature) = 1
+			`, t, simHashBandBits, 1<<simHashBandBits-1, 64/simHashBandBits-1),
+			fmt.Sprintf(`
+				UPDATE %s SET bands = ARRAY(
+					SELECT i::bigint%s
+					FROM generate_series(0, cardinality(signature) / %d - 1) AS i ORDER BY i
+				)
+				WHERE cardinality(signature) > 1 AND cardinality(signature) %% %[3]d = 0
+			`, t, minHashBandXor(), minHashBandRows),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING GIN (bands)", pq.QuoteIdentifier(derivedName(table, bandsIndexSuffix)), t),
+		}
+	},
+}
+
+func minHashBandXor() string {
+	var b strings.Builder
+	for r := range minHashBandRows {
+		fmt.Fprintf(&b, " # signature[%d * i + %d]", minHashBandRows, r+1)
+	}
+	return b.String()
+}
+
+func (s *pgStore) schemaTable() string {
+	return pq.QuoteIdentifier(s.tableName + schemaTableSuffix)
+}
+
+func (s *pgStore) initSchema(ctx context.Context) error {
+	query := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			table_name TEXT PRIMARY KEY,
+			version INTEGER NOT NULL DEFAULT 0,
+			index_spec TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+		)
+	`, s.schemaTable())
+	if _, err := s.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	tables := map[string]int{s.tableName: 0}
+	query = fmt.Sprintf("SELECT table_name, dimension FROM %s", s.registryTable())
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table string
+		var dim int
+		if err := rows.Scan(&table, &dim); err != nil {
+			return err
+		}
+		tables[table] = dim
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for table, dim := range tables {
+		if err := s.migrateTable(ctx, table, dim); err != nil {
+			return fmt.Errorf("migrate %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (s *pgStore) migrateTable(ctx context.Context, table string, dim int) error {
+	txn, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := s.migrate(ctx, txn, table, dim); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// migrate also types the embedding column and rebuilds the vector index when
+// the dimension is known or the index options changed.
+func (s *pgStore) migrate(ctx context.Context, txn *sql.Tx, table string, dim int) error {
+	if _, err := txn.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", s.schemaTable()+"."+table); err != nil {
+		return err
+	}
+
+	var version int
+	var spec string
+	query := fmt.Sprintf("SELECT version, index_spec FROM %s WHERE table_name = $1", s.schemaTable())
+	err := txn.QueryRowContext(ctx, query, table).Scan(&version, &spec)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		for _, stmt := range migrations[version](table, dim) {
+			if _, err := txn.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dim > 0 {
+		if err := s.typeEmbedding(ctx, txn, table, dim); err != nil {
+			return err
+		}
+		if want := s.index.spec(); want != spec {
+			if err := s.buildIndex(ctx, txn, table); err != nil {
+				return err
+			}
+			spec = want
+		}
+	}
+
+	query = fmt.Sprintf(`
+		INSERT INTO %s (table_name, version, index_spec, updated_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (table_name) DO UPDATE SET version = $2, index_spec = $3, updated_at = CURRENT_TIMESTAMP
+	`, s.schemaTable())
+	_, err = txn.ExecContext(ctx, query, table, version, spec)
+	return err
+}
+
+func (s *pgStore) typeEmbedding(ctx context.Context, txn *sql.Tx, table string, dim int) error {
+	var current string
+	query := "SELECT format_type(atttypid, atttypmod) FROM pg_attribute WHERE attrelid = $1::regclass AND attname = 'embedding'"
+	if err := txn.QueryRowContext(ctx, query, pq.QuoteIdentifier(table)).Scan(&current); err != nil {
+		return err
+	}
+	if current == vectorType(dim) {
+		return nil
+	}
+
+	query = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN embedding TYPE %s", pq.QuoteIdentifier(table), vectorType(dim))
+	if _, err := txn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("%w: table %s: %v", ErrEmbeddingMismatch, table, err)
+	}
+	return nil
+}
+
+func (s *pgStore) buildIndex(ctx context.Context, txn *sql.Tx, table string) error {
+	name := pq.QuoteIdentifier(derivedName(table, embeddingIndexSuffix))
+	if _, err := txn.ExecContext(ctx, fmt.Sprintf("DROP INDEX IF EXISTS %s", name)); err != nil {
+		return err
+	}
+
+	var query string
+	switch s.index.Type {
+	case IndexNone:
+		return nil
+	case IndexIVFFlat:
+		query = fmt.Sprintf("CREATE INDEX %s ON %s USING ivfflat (embedding vector_cosine_ops) WITH (lists = %d)",
+			name, pq.QuoteIdentifier(table), positiveOr(s.index.Lists, defaultIVFFlatLists))
+	default:
+		query = fmt.Sprintf("CREATE INDEX %s ON %s USING hnsw (embedding vector_cosine_ops) WITH (m = %d, ef_construction = %d)",
+			name, pq.QuoteIdentifier(table), positiveOr(s.index.M, defaultHNSWM), positiveOr(s.index.EFConstruction, defaultHNSWEFConstruction))
+	}
+	_, err := txn.ExecContext(ctx, query)
+	return err
+}
+
+func derivedName(table, suffix string) string {
+	return table[:min(len(table), maxIdentifierLength-len(suffix))] + suffix
+}
+
+func historyTable(table string) string {
+	return derivedName(table, historyTableSuffix)
+}
+
+func (o IndexOptions) spec() string {
+	switch o.Type {
+	case IndexNone:
+		return string(IndexNone)
+	case IndexIVFFlat:
+		return fmt.Sprintf("%s:lists=%d", IndexIVFFlat, positiveOr(o.Lists, defaultIVFFlatLists))
+	default:
+		return fmt.Sprintf("%s:m=%d,ef_construction=%d", IndexHNSW, positiveOr(o.M, defaultHNSWM), positiveOr(o.EFConstruction, defaultHNSWEFConstruction))
+	}
+}
+
+func (o IndexOptions) searchSettings() []string {
+	var settings []string
+	if o.EFSearch > 0 {
+		settings = append(settings, fmt.Sprintf("SET LOCAL hnsw.ef_search = %d", o.EFSearch))
+	}
+	if o.Probes > 0 {
+		settings = append(settings, fmt.Sprintf("SET LOCAL ivfflat.probes = %d", o.Probes))
+	}
+	return settings
+}
+
+func positiveOr(v, fallback int) int {
+	if v > 0 {
+		return v
+	}
+	return fallback
+}
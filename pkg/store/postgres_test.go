@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// hostileMetadata holds keys and values that break SQL built by string
+// concatenation.
+var hostileMetadata = map[string]string{
+	"quote'key":    "it's",
+	`double"key`:   `say "hi"`,
+	"semi;key":     "a; DROP TABLE users; --",
+	"comment--key": "-- rest",
+	"$1":           "$1",
+	"key":          `'); DELETE FROM x WHERE ('1'='1`,
+}
+
+func TestPostgresRejectsHostileTableNames(t *testing.T) {
+	for _, name := range []string{
+		"",
+		`"docs"`,
+		`docs"; DROP TABLE docs; --`,
+		"docs'",
+		"Docs",
+		"docs-1",
+		"9docs",
+		strings.Repeat("a", maxTableLength+1),
+	} {
+		if _, err := NewPostgresStore("", name, PostgresOptions{}); err == nil {
+			t.Errorf("table name %q was accepted", name)
+		}
+	}
+}
+
+func TestCollectionNameRejectsHostileNames(t *testing.T) {
+	for _, name := range []string{
+		`"docs"`,
+		"docs'; DROP TABLE docs; --",
+		"docs;",
+		"docs$1",
+		strings.Repeat("a", 49),
+	} {
+		if _, err := collectionName(name); err == nil {
+			t.Errorf("collection name %q was accepted", name)
+		}
+	}
+}
+
+func TestPostgresOverlongCollectionTable(t *testing.T) {
+	s := newTestPostgres(t)
+	ctx := context.Background()
+
+	name := strings.Repeat("c", maxTableLength-len(s.tableName))
+	if err := s.CreateCollection(ctx, Collection{Name: name}); err == nil {
+		t.Errorf("collection %q deriving a %d character table was created", name, len(s.tableFor(name)))
+	}
+	name = name[:len(name)-1]
+	if err := s.CreateCollection(ctx, Collection{Name: name}); err != nil {
+		t.Errorf("collection %q: %v", name, err)
+	}
+}
+
+func TestPostgresHostileMetadata(t *testing.T) {
+	s := newTestPostgres(t)
+	ctx := context.Background()
+
+	if _, err := s.AddDocument(ctx, "", "doc'; --", "some text", hostileMetadata, AddOptions{ChunkSize: 100}, testEmbeddings); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddDocument(ctx, "", "other", "other text", map[string]string{"key": "plain"}, AddOptions{ChunkSize: 100}, testEmbeddings); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range hostileMetadata {
+		filter := map[string]string{key: value}
+		results, err := s.Search(ctx, "", []float32{1, 0, 0}, SearchOptions{TopK: 10, MMRLambda: 1, Metadata: filter})
+		if err != nil {
+			t.Fatalf("Search filtering on %q: %v", key, err)
+		}
+		if len(results) != 1 || results[0].DocID != "doc'; --" || !maps.Equal(results[0].Metadata, hostileMetadata) {
+			t.Errorf("Search filtering on %q = %+v", key, results)
+		}
+
+		docs, err := s.ListDocuments(ctx, "", ListOptions{Metadata: filter})
+		if err != nil {
+			t.Fatalf("ListDocuments filtering on %q: %v", key, err)
+		}
+		if len(docs) != 1 || docs[0].DocID != "doc'; --" {
+			t.Errorf("ListDocuments filtering on %q = %+v", key, docs)
+		}
+
+		n, err := s.CountChunks(ctx, "", filter)
+		if err != nil {
+			t.Fatalf("CountChunks filtering on %q: %v", key, err)
+		}
+		if n != 1 {
+			t.Errorf("CountChunks filtering on %q = %d, want 1", key, n)
+		}
+	}
+
+	updated := map[string]string{"$2": "'; TRUNCATE other; --", `"`: `\`}
+	if err := s.UpdateMetadata(ctx, "", "doc'; --", updated); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := s.GetDocument(ctx, "", "doc'; --")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(doc.Metadata, updated) {
+		t.Errorf("metadata after update = %v, want %v", doc.Metadata, updated)
+	}
+	if _, err := s.GetDocument(ctx, "", "other"); err != nil {
+		t.Errorf("other document: %v", err)
+	}
+}
+
+func TestPostgresSearchTopKBounds(t *testing.T) {
+	checkTopKBounds(t, newTestPostgres(t))
+}
+
+func TestPostgresReaddRefreshesDocument(t *testing.T) {
+	checkReaddRefreshes(t, newTestPostgres(t))
+}
+
+// newTestPostgres connects to the database the POSTGRES_* variables describe
+// and skips the test when POSTGRES_HOST is unset. The store uses a fresh
+// table name and drops its tables when the test ends.
+func newTestPostgres(t *testing.T) *pgStore {
+	t.Helper()
+	host := os.Getenv("POSTGRES_HOST")
+	if host == "" {
+		t.Skip("POSTGRES_HOST is not set")
+	}
+
+	params := []string{"host=" + host}
+	for key, env := range map[string]string{
+		"port":     "POSTGRES_PORT",
+		"user":     "POSTGRES_USER",
+		"password": "POSTGRES_PASSWORD",
+		"dbname":   "POSTGRES_DBNAME",
+		"sslmode":  "POSTGRES_SSLMODE",
+	} {
+		if v := os.Getenv(env); v != "" {
+			params = append(params, fmt.Sprintf("%s='%s'", key, strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)))
+		}
+	}
+
+	table := fmt.Sprintf("rag_test_%d", time.Now().UnixNano())
+	s, err := NewPostgresStore(strings.Join(params, " "), table, PostgresOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg := s.(*pgStore)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		tables := []string{table, table + collectionsTableSuffix, table + schemaTableSuffix}
+		rows, err := pg.db.QueryContext(ctx, fmt.Sprintf("SELECT table_name FROM %s", pg.registryTable()))
+		if err == nil {
+			for rows.Next() {
+				var name string
+				if rows.Scan(&name) == nil {
+					tables = append(tables, name)
+				}
+			}
+			rows.Close()
+		}
+		for _, name := range tables {
+			for _, name := range []string{name, historyTable(name)} {
+				if _, err := pg.db.ExecContext(ctx, "DROP TABLE IF EXISTS "+pq.QuoteIdentifier(name)); err != nil {
+					t.Errorf("drop %s: %v", name, err)
+				}
+			}
+		}
+		pg.db.Close()
+	})
+	return pg
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const versionColumns = "doc_id, version, chunk_index, content, metadata, parent_index, parent_content, embedding, created_at, expires_at, duplicate_of, duplicate_index, weight"
+
+// The caller holds the document lock and removes the current rows.
+func (s *pgStore) archive(ctx context.Context, txn *sql.Tx, table, docID string, now time.Time) (int, error) {
+	current, history := pq.QuoteIdentifier(table), pq.QuoteIdentifier(historyTable(table))
+
+	var latest sql.NullInt64
+	query := fmt.Sprintf(`
+		SELECT GREATEST(
+			(SELECT MAX(version) FROM %s WHERE doc_id = $1),
+			(SELECT MAX(version) FROM %s WHERE doc_id = $1)
+		)
+	`, current, history)
+	if err := txn.QueryRowContext(ctx, query, docID).Scan(&latest); err != nil {
+		return 0, err
+	}
+	if s.retention.KeepVersions == 0 {
+		return int(latest.Int64) + 1, nil
+	}
+
+	query = fmt.Sprintf(`
+		INSERT INTO %s (doc_id, version, chunk_index, hash, chunk_hash, content, embedding, metadata, parent_index, parent_content, created_at, expires_at, duplicate_of, duplicate_index, weight, replaced_at)
+		SELECT doc_id, version, chunk_index, hash, chunk_hash, content, embedding, metadata, parent_index, parent_content, created_at, expires_at, duplicate_of, duplicate_index, weight, $2
+		FROM %s
+		WHERE doc_id = $1
+	`, history, current)
+	res, err := txn.ExecContext(ctx, query, docID, now)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return int(latest.Int64) + 1, err
+	}
+
+	var oldest int64
+	if s.retention.KeepVersions > 0 {
+		oldest = latest.Int64 - int64(s.retention.KeepVersions)
+	}
+	var cutoff sql.NullTime
+	if s.retention.MaxAge > 0 {
+		cutoff = sql.NullTime{Time: now.Add(-s.retention.MaxAge), Valid: true}
+	}
+	query = fmt.Sprintf("DELETE FROM %s WHERE doc_id = $1 AND (version <= $2 OR replaced_at < $3)", history)
+	if _, err := txn.ExecContext(ctx, query, docID, oldest, cutoff); err != nil {
+		return 0, err
+	}
+	return int(latest.Int64) + 1, nil
+}
+
+// A search as of a time or version also reads the history table.
+func (s *pgStore) searchSource(table string, options SearchOptions, where string, args []interface{}, start int) (string, string, []interface{}) {
+	if !options.versioned() {
+		return pq.QuoteIdentifier(table), where, args
+	}
+
+	var conds []string
+	if options.Version > 0 {
+		args = append(args, options.Version)
+		conds = append(conds, fmt.Sprintf("version = $%d", start+len(args)-1))
+	}
+	if !options.AsOf.IsZero() {
+		args = append(args, options.AsOf)
+		n := start + len(args) - 1
+		conds = append(conds, fmt.Sprintf("created_at <= $%d AND (replaced_at IS NULL OR replaced_at > $%d)", n, n))
+	}
+	if where == "" {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	} else {
+		where += " AND " + strings.Join(conds, " AND ")
+	}
+
+	source := fmt.Sprintf(`(
+		SELECT %[3]s, NULL::timestamptz AS replaced_at FROM %[1]s
+		UNION ALL
+		SELECT %[3]s, replaced_at FROM %[2]s
+	) AS versions`, pq.QuoteIdentifier(table), pq.QuoteIdentifier(historyTable(table)), versionColumns)
+	return source, where, args
+}
+
+func (s *pgStore) ListVersions(ctx context.Context, collection string, docID string) ([]VersionInfo, error) {
+	_, table, err := s.collection(ctx, collection, false)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT version, MIN(hash), (ARRAY_AGG(metadata))[1], COUNT(*), MIN(created_at), NULL::timestamptz
+		FROM %s
+		WHERE doc_id = $1
+		GROUP BY version
+		UNION ALL
+		SELECT version, MIN(hash), (ARRAY_AGG(metadata))[1], COUNT(*), MIN(created_at), MIN(replaced_at)
+		FROM %s
+		WHERE doc_id = $1
+		GROUP BY version
+	`, pq.QuoteIdentifier(table), pq.QuoteIdentifier(historyTable(table)))
+	rows, err := s.db.QueryContext(ctx, query, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []VersionInfo
+	for rows.Next() {
+		var v VersionInfo
+		var metaJSON []byte
+		var replacedAt sql.NullTime
+		if err := rows.Scan(&v.Version, &v.Hash, &metaJSON, &v.ChunkCount, &v.CreatedAt, &replacedAt); err != nil {
+			return nil, err
+		}
+		if v.Metadata, err = decodeMetadata(metaJSON); err != nil {
+			return nil, err
+		}
+		v.CreatedAt = v.CreatedAt.In(jst)
+		if replacedAt.Valid {
+			v.ReplacedAt = replacedAt.Time.In(jst)
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+
+	sortVersions(versions)
+	return versions, nil
+}
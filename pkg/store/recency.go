@@ -0,0 +1,91 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	DecayExponential = "exponential"
+	DecayLinear      = "linear"
+	DecayStep        = "step"
+
+	defaultHalfLife = 30 * 24 * time.Hour
+)
+
+var metadataDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006/01/02",
+}
+
+type RecencyOptions struct {
+	Decay    string
+	HalfLife time.Duration
+	Window   time.Duration
+	DateKey  string
+	Now      time.Time
+}
+
+func (o RecencyOptions) validate() error {
+	switch o.Decay {
+	case "", DecayExponential, DecayLinear, DecayStep:
+		return nil
+	}
+	return fmt.Errorf("unsupported recency decay %q", o.Decay)
+}
+
+func (o RecencyOptions) now() time.Time {
+	if o.Now.IsZero() {
+		return time.Now()
+	}
+	return o.Now
+}
+
+func (o RecencyOptions) date(createdAt time.Time, metadata map[string]string) time.Time {
+	if o.DateKey == "" {
+		return createdAt
+	}
+	v, ok := metadata[o.DateKey]
+	if !ok {
+		return createdAt
+	}
+	for _, layout := range metadataDateLayouts {
+		if t, err := time.ParseInLocation(layout, v, jst); err == nil {
+			return t
+		}
+	}
+	return createdAt
+}
+
+func (o RecencyOptions) score(now, createdAt time.Time, metadata map[string]string) float32 {
+	age := now.Sub(o.date(createdAt, metadata))
+	if age < 0 {
+		age = 0
+	}
+
+	halfLife := o.HalfLife
+	if halfLife <= 0 {
+		halfLife = defaultHalfLife
+	}
+
+	switch o.Decay {
+	case DecayLinear:
+		window := o.Window
+		if window <= 0 {
+			window = 2 * halfLife
+		}
+		return float32(math.Max(0, 1-float64(age)/float64(window)))
+	case DecayStep:
+		steps := math.Floor(float64(age) / float64(halfLife))
+		return float32(math.Pow(0.5, steps))
+	default: // DecayExponential
+		return float32(math.Pow(0.5, float64(age)/float64(halfLife)))
+	}
+}
+
+func blendRecency(similarity, recency, weight float32) float32 {
+	return (1.0-weight)*similarity + weight*recency
+}
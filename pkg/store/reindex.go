@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+)
+
+const (
+	reindexSuffix           = "_reindex"
+	defaultReindexBatchSize = 64
+)
+
+var ErrReindexUnsupported = errors.New("store does not support reindexing")
+
+type Reindexer interface {
+	PutDocument(ctx context.Context, collection string, doc Document) error
+	SwapCollection(ctx context.Context, collection string, shadow string) error
+}
+
+type ReindexOptions struct {
+	EmbeddingModel string
+	BatchSize      int
+	Progress       func(done, total int)
+}
+
+// Reindex re-embeds collection into a shadow collection and swaps it in.
+// Documents already copied are skipped, so an interrupted run resumes.
+// Archived versions are dropped with the old data.
+func Reindex(ctx context.Context, s Store, collection string, options ReindexOptions, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) error {
+	r, ok := s.(Reindexer)
+	if !ok {
+		return ErrReindexUnsupported
+	}
+	name, err := collectionName(collection)
+	if err != nil {
+		return err
+	}
+	shadow, err := collectionName(name + reindexSuffix)
+	if err != nil {
+		return fmt.Errorf("collection %q cannot be reindexed: %w", name, err)
+	}
+
+	collections, err := s.ListCollections(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := findCollection(collections, name); !ok {
+		return ErrCollectionNotFound
+	}
+	if existing, ok := findCollection(collections, shadow); ok {
+		if existing.EmbeddingModel != options.EmbeddingModel {
+			return fmt.Errorf("a reindex of %q to model %q is in progress; drop collection %q to start over", name, existing.EmbeddingModel, shadow)
+		}
+	} else if err := s.CreateCollection(ctx, Collection{Name: shadow, EmbeddingModel: options.EmbeddingModel}); err != nil {
+		return err
+	}
+
+	docs, err := s.ListDocuments(ctx, name, ListOptions{})
+	if err != nil {
+		return err
+	}
+	copied, err := s.ListDocuments(ctx, shadow, ListOptions{})
+	if err != nil {
+		return err
+	}
+	done := make(map[string]DocumentInfo, len(copied))
+	for _, info := range copied {
+		done[info.DocID] = info
+	}
+
+	for i, info := range docs {
+		prev, ok := done[info.DocID]
+		delete(done, info.DocID)
+		switch {
+		case ok && prev.Hash == info.Hash && maps.Equal(prev.Metadata, info.Metadata):
+		case ok && prev.Hash == info.Hash:
+			err = s.UpdateMetadata(ctx, shadow, info.DocID, info.Metadata)
+		default:
+			err = reembed(ctx, r, s, name, shadow, info.DocID, options.BatchSize, embeddingsFunc)
+		}
+		if err != nil {
+			return fmt.Errorf("reindex %q: %w", info.DocID, err)
+		}
+		if options.Progress != nil {
+			options.Progress(i+1, len(docs))
+		}
+	}
+
+	for docID := range done {
+		if err := s.DeleteDocument(ctx, shadow, docID); err != nil {
+			return err
+		}
+	}
+
+	return r.SwapCollection(ctx, name, shadow)
+}
+
+func reembed(ctx context.Context, r Reindexer, s Store, collection, shadow, docID string, batchSize int, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) error {
+	doc, err := s.GetDocument(ctx, collection, docID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if batchSize <= 0 {
+		batchSize = defaultReindexBatchSize
+	}
+	texts := chunkTexts(doc.Chunks)
+	for start := 0; start < len(texts); start += batchSize {
+		end := min(start+batchSize, len(texts))
+		embeddings, err := embeddingsFunc(ctx, texts[start:end])
+		if err != nil {
+			return err
+		}
+		if len(embeddings) != end-start {
+			return fmt.Errorf("got %d embeddings for %d chunks", len(embeddings), end-start)
+		}
+		for i, emb := range embeddings {
+			doc.Chunks[start+i].Embedding = emb
+		}
+	}
+
+	return r.PutDocument(ctx, shadow, *doc)
+}
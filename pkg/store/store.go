@@ -2,21 +2,459 @@ package store
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/tik-choco-lab/rag/pkg/content"
 )
 
+const (
+	parentSampleMultiplier = 3
+
+	maxTopK = 1000
+)
+
+var (
+	ErrNotFound           = errors.New("document not found")
+	ErrCollectionNotFound = errors.New("collection not found")
+	ErrCollectionExists   = errors.New("collection already exists")
+	ErrEmbeddingMismatch  = errors.New("embedding model or dimension mismatch")
+)
+
+type AddOptions struct {
+	EmbeddingModel string
+	ChunkSize      int
+	Overlap        int
+	ParentSize     int
+	ParentOverlap  int
+
+	ExpiresAt time.Time
+	Dedup     DedupOptions
+}
+
+type AddResult struct {
+	Added   int
+	Kept    int
+	Removed int
+	// Duplicates includes the chunks skipped.
+	Duplicates int
+}
+
 type SearchOptions struct {
-	TopK          int
-	Threshold     float32
-	MMRLambda     float32
-	RecencyWeight float32
-	Metadata      map[string]string
+	EmbeddingModel string
+	TopK           int
+	Threshold      float32
+	MMRLambda      float32
+	RecencyWeight  float32
+	Recency        RecencyOptions
+	ReturnParents  bool
+	Neighbors      int
+	Metadata       map[string]string
+
+	// Overlap is the AddOptions.Overlap stripped when stitching neighbours.
+	Overlap int
+
+	AsOf    time.Time
+	Version int
+
+	CollapseDuplicates bool
+}
+
+func (o SearchOptions) validate() error {
+	if o.TopK < 0 || o.TopK > maxTopK {
+		return fmt.Errorf("top k %d out of range [0, %d]", o.TopK, maxTopK)
+	}
+	return o.Recency.validate()
+}
+
+func (o SearchOptions) sampleSize() int {
+	k := o.TopK
+	if o.ReturnParents {
+		k *= parentSampleMultiplier
+	}
+	if o.CollapseDuplicates {
+		k *= duplicateSampleMultiplier
+	}
+	return k
+}
+
+type ListOptions struct {
+	Offset   int
+	Limit    int
+	Metadata map[string]string
+}
+
+type DocumentInfo struct {
+	DocID      string
+	Version    int
+	Hash       string
+	Metadata   map[string]string
+	ChunkCount int
+	CreatedAt  time.Time
+	Date       string
+	ExpiresAt  time.Time
+}
+
+type Document struct {
+	DocumentInfo
+	Chunks []Chunk
+}
+
+type Chunk struct {
+	Index int
+	Hash  string
+	Text  string
+
+	// ParentText is set on the first chunk of each parent only.
+	ParentIndex int
+	ParentText  string
+	Embedding   []float32
+
+	Signature   []uint64
+	DuplicateOf ChunkRef
+	Weight      float32
+}
+
+func (c Chunk) weight() float32 {
+	if c.Weight > 0 {
+		return c.Weight
+	}
+	return 1
 }
 
 type Store interface {
-	AddDocument(ctx context.Context, docID string, text string, metadata map[string]string, chunkSize, overlap int, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) error
-	Search(ctx context.Context, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error)
-	RecencySearch(ctx context.Context, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error)
-	DeleteDocument(ctx context.Context, docID string) error
+	CreateCollection(ctx context.Context, collection Collection) error
+	ListCollections(ctx context.Context) ([]Collection, error)
+	DropCollection(ctx context.Context, name string) error
+	AddDocument(ctx context.Context, collection string, docID string, text string, metadata map[string]string, options AddOptions, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) (AddResult, error)
+	AddChunks(ctx context.Context, collection string, doc Document, options AddOptions, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) (AddResult, error)
+	PutDocument(ctx context.Context, collection string, doc Document) error
+	Search(ctx context.Context, collection string, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error)
+	RecencySearch(ctx context.Context, collection string, queryEmbedding []float32, options SearchOptions) ([]content.SearchResult, error)
+	DeleteDocument(ctx context.Context, collection string, docID string) error
+	ListDocuments(ctx context.Context, collection string, options ListOptions) ([]DocumentInfo, error)
+	GetDocument(ctx context.Context, collection string, docID string) (*Document, error)
+	UpdateMetadata(ctx context.Context, collection string, docID string, metadata map[string]string) error
+	CountChunks(ctx context.Context, collection string, metadata map[string]string) (int, error)
+	ListVersions(ctx context.Context, collection string, docID string) ([]VersionInfo, error)
+	Purge(ctx context.Context, collection string) (int, error)
+}
+
+type Compactor interface {
+	Compact(ctx context.Context, collection string) error
+}
+
+type RecallEvaluator interface {
+	QuantizationRecall(ctx context.Context, collection string, queries [][]float32, k int) (content.RecallReport, error)
+}
+
+func newDocument(docID string, text string, metadata map[string]string, options AddOptions) Document {
+	cleanText := content.CleanText(text)
+	return Document{
+		DocumentInfo: DocumentInfo{DocID: docID, Hash: content.CalculateHash(cleanText), Metadata: metadata},
+		Chunks:       SplitDocument(cleanText, options),
+	}
+}
+
+// completeHashes copies the chunks and fills in missing hashes.
+func completeHashes(doc Document) Document {
+	doc.Chunks = shareParents(slices.Clone(doc.Chunks), parentTexts(doc.Chunks))
+	hashes := make([]string, len(doc.Chunks))
+	for i, c := range doc.Chunks {
+		if c.Hash == "" {
+			doc.Chunks[i].Hash = content.CalculateHash(c.Text)
+		}
+		hashes[i] = doc.Chunks[i].Hash
+	}
+	if doc.Hash == "" {
+		doc.Hash = content.CalculateHash(strings.Join(hashes, "\n"))
+	}
+	return doc
+}
+
+func providedEmbeddings(chunks []Chunk) [][]float32 {
+	var embeddings [][]float32
+	for _, c := range chunks {
+		if len(c.Embedding) > 0 {
+			embeddings = append(embeddings, c.Embedding)
+		}
+	}
+	return embeddings
+}
+
+func parentTexts(chunks []Chunk) map[int]string {
+	parents := make(map[int]string)
+	for _, c := range chunks {
+		if c.ParentText != "" {
+			parents[c.ParentIndex] = c.ParentText
+		}
+	}
+	return parents
+}
+
+func shareParents(chunks []Chunk, parents map[int]string) []Chunk {
+	given := make(map[int]bool)
+	for i, c := range chunks {
+		chunks[i].ParentText = ""
+		if text := parents[c.ParentIndex]; text != "" && !given[c.ParentIndex] {
+			given[c.ParentIndex] = true
+			chunks[i].ParentText = text
+		}
+	}
+	return chunks
+}
+
+func SplitDocument(text string, options AddOptions) []Chunk {
+	if options.ParentSize <= 0 {
+		var chunks []Chunk
+		for i, t := range content.SplitText(text, options.ChunkSize, options.Overlap) {
+			chunks = append(chunks, Chunk{Index: i, Hash: content.CalculateHash(t), Text: t})
+		}
+		return chunks
+	}
+
+	var chunks []Chunk
+	for p, parent := range content.SplitText(text, options.ParentSize, options.ParentOverlap) {
+		for i, t := range content.SplitText(parent, options.ChunkSize, options.Overlap) {
+			chunk := Chunk{
+				Index:       len(chunks),
+				Hash:        content.CalculateHash(t),
+				Text:        t,
+				ParentIndex: p,
+			}
+			if i == 0 {
+				chunk.ParentText = parent
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+func paginate[T any](items []T, offset, limit int) []T {
+	if offset >= len(items) {
+		return nil
+	}
+	items = items[max(offset, 0):]
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
+
+func chunkTexts(chunks []Chunk) []string {
+	texts := make([]string, len(chunks))
+	for i, c := range chunks {
+		texts[i] = c.Text
+	}
+	return texts
+}
+
+// reuseEmbeddings returns the chunks that still need an embedding and which
+// were kept from previous.
+func reuseEmbeddings(chunks []Chunk, previous []Chunk) ([]int, []bool, AddResult) {
+	stored := make(map[string][][]float32)
+	for _, c := range previous {
+		h := c.Hash
+		if h == "" {
+			h = content.CalculateHash(c.Text)
+		}
+		stored[h] = append(stored[h], c.Embedding)
+	}
+
+	var missing []int
+	var result AddResult
+	kept := make([]bool, len(chunks))
+	for i, c := range chunks {
+		embs := stored[c.Hash]
+		if len(embs) == 0 {
+			if len(c.Embedding) == 0 {
+				missing = append(missing, i)
+			}
+			result.Added++
+			continue
+		}
+		if len(c.Embedding) == 0 {
+			chunks[i].Embedding = embs[len(embs)-1]
+		}
+		stored[c.Hash] = embs[:len(embs)-1]
+		kept[i] = true
+		result.Kept++
+	}
+	result.Removed = len(previous) - result.Kept
+	return missing, kept, result
+}
+
+func embedChunks(ctx context.Context, chunks []Chunk, missing []int, embeddingsFunc func(ctx context.Context, chunks []string) ([][]float32, error)) error {
+	if len(missing) == 0 {
+		return nil
+	}
+	if embeddingsFunc == nil {
+		return fmt.Errorf("%d chunks have no embedding and no embeddings function was given", len(missing))
+	}
+
+	texts := make([]string, len(missing))
+	for i, idx := range missing {
+		texts[i] = chunks[idx].Text
+	}
+	embeddings, err := embeddingsFunc(ctx, texts)
+	if err != nil {
+		return err
+	}
+	if len(embeddings) != len(texts) {
+		return fmt.Errorf("got %d embeddings for %d chunks", len(embeddings), len(texts))
+	}
+	for i, idx := range missing {
+		chunks[idx].Embedding = embeddings[i]
+	}
+	return nil
+}
+
+func chunkEmbeddings(chunks []Chunk) [][]float32 {
+	embeddings := make([][]float32, len(chunks))
+	for i, c := range chunks {
+		embeddings[i] = c.Embedding
+	}
+	return embeddings
+}
+
+type hit struct {
+	result      content.SearchResult
+	duplicateOf ChunkRef
+}
+
+type parentTextFunc func(ctx context.Context, docID string, parentIndex int) (string, error)
+
+func collectResults(ctx context.Context, hits []hit, options SearchOptions, parents parentTextFunc) ([]content.SearchResult, error) {
+	type parentKey struct {
+		docID string
+		index int
+	}
+	seen := make(map[parentKey]bool)
+	if options.CollapseDuplicates {
+		hits = collapseDuplicates(hits)
+	}
+
+	var results []content.SearchResult
+	for _, h := range hits {
+		res := h.result
+		if options.ReturnParents {
+			key := parentKey{docID: res.DocID, index: res.ParentIndex}
+			if seen[key] {
+				continue
+			}
+			text, err := parents(ctx, res.DocID, res.ParentIndex)
+			if err != nil {
+				return nil, err
+			}
+			if text != "" {
+				seen[key] = true
+				res.Text = text
+			}
+		}
+		results = append(results, res)
+		if len(results) == options.TopK {
+			break
+		}
+	}
+	return results, nil
+}
+
+type chunkRangeFunc func(ctx context.Context, docID string, from, to int) ([]Chunk, error)
+
+// expandNeighbors widens each result to the chunks of its parent within
+// options.Neighbors. Results whose windows touch merge into the first.
+func expandNeighbors(ctx context.Context, results []content.SearchResult, options SearchOptions, fetch chunkRangeFunc) ([]content.SearchResult, error) {
+	if options.Neighbors <= 0 || options.ReturnParents {
+		return results, nil
+	}
+
+	type windowKey struct {
+		docID  string
+		parent int
+	}
+	type window struct {
+		from, to int
+		members  []int
+	}
+	windows := make(map[windowKey][]window)
+	for i, res := range results {
+		key := windowKey{docID: res.DocID, parent: res.ParentIndex}
+		windows[key] = append(windows[key], window{
+			from:    max(res.ChunkIndex-options.Neighbors, 0),
+			to:      res.ChunkIndex + options.Neighbors,
+			members: []int{i},
+		})
+	}
+
+	var merged []window
+	for _, ws := range windows {
+		slices.SortFunc(ws, func(a, b window) int { return a.from - b.from })
+		current := ws[0]
+		for _, w := range ws[1:] {
+			if w.from > current.to+1 {
+				merged = append(merged, current)
+				current = w
+				continue
+			}
+			current.to = max(current.to, w.to)
+			current.members = append(current.members, w.members...)
+		}
+		merged = append(merged, current)
+	}
+	for i := range merged {
+		slices.Sort(merged[i].members)
+	}
+	slices.SortFunc(merged, func(a, b window) int { return a.members[0] - b.members[0] })
+
+	var expanded []content.SearchResult
+	for _, w := range merged {
+		res := results[w.members[0]]
+		chunks, err := fetch(ctx, res.DocID, w.from, w.to)
+		if err != nil {
+			return nil, err
+		}
+		text, ok := stitchWindow(chunks, res.ParentIndex, options.Overlap)
+		if !ok {
+			for _, m := range w.members {
+				expanded = append(expanded, results[m])
+			}
+			continue
+		}
+		if text != "" {
+			res.Text = text
+		}
+		expanded = append(expanded, res)
+	}
+	return expanded, nil
+}
+
+// stitchWindow reports false when chunk indices repeat.
+func stitchWindow(chunks []Chunk, parent, overlap int) (string, bool) {
+	var text string
+	seen := make(map[int]bool)
+	previous := -1
+	for _, c := range chunks {
+		if seen[c.Index] {
+			return "", false
+		}
+		seen[c.Index] = true
+		if c.ParentIndex != parent {
+			continue
+		}
+
+		switch {
+		case previous < 0:
+			text = c.Text
+		case c.Index == previous+1:
+			text = content.MergeOverlap(text, c.Text, overlap)
+		default:
+			text += "\n\n" + c.Text
+		}
+		previous = c.Index
+	}
+	return text, true
 }
@@ -0,0 +1,54 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+const spillFilePattern = ".vectors-*"
+
+// spillVectors moves the embeddings into a mapped, unlinked file in dir. The
+// release func is nil when they could not be mapped and stay in memory.
+func spillVectors(dir string, records []record) (func() error, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+	f, err := os.CreateTemp(dir, spillFilePattern)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var buf [float32ByteLength]byte
+	for _, r := range records {
+		for _, v := range r.Embedding {
+			binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+			if _, err := w.Write(buf[:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	data, release, err := mapFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	vectors, ok := float32View(data, dtypeCodeFloat32)
+	if !ok {
+		return nil, release()
+	}
+	off := 0
+	for i, r := range records {
+		n := len(r.Embedding)
+		records[i].Embedding = vectors[off : off+n : off+n]
+		off += n
+	}
+	return release, nil
+}
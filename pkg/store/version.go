@@ -0,0 +1,57 @@
+package store
+
+import (
+	"slices"
+	"time"
+)
+
+// A negative KeepVersions keeps every version and zero none.
+type RetentionOptions struct {
+	KeepVersions int
+	MaxAge       time.Duration
+}
+
+func (o RetentionOptions) keeps(version, latest int, replacedAt, now time.Time) bool {
+	if o.KeepVersions == 0 {
+		return false
+	}
+	if o.KeepVersions > 0 && version <= latest-o.KeepVersions {
+		return false
+	}
+	return !o.outlived(replacedAt, now)
+}
+
+func (o RetentionOptions) outlived(replacedAt, now time.Time) bool {
+	return o.MaxAge > 0 && replacedAt.Before(now.Add(-o.MaxAge))
+}
+
+// ReplacedAt is zero for the current version.
+type VersionInfo struct {
+	Version    int
+	Hash       string
+	Metadata   map[string]string
+	ChunkCount int
+	CreatedAt  time.Time
+	ReplacedAt time.Time
+}
+
+func (o SearchOptions) versioned() bool {
+	return o.Version > 0 || !o.AsOf.IsZero()
+}
+
+// replacedAt is zero while the version is current.
+func (o SearchOptions) selects(version int, createdAt, replacedAt time.Time) bool {
+	if o.Version > 0 && version != o.Version {
+		return false
+	}
+	if o.AsOf.IsZero() {
+		return true
+	}
+	return !createdAt.After(o.AsOf) && (replacedAt.IsZero() || replacedAt.After(o.AsOf))
+}
+
+func sortVersions(versions []VersionInfo) {
+	slices.SortFunc(versions, func(a, b VersionInfo) int {
+		return a.Version - b.Version
+	})
+}
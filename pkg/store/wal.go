@@ -0,0 +1,182 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tik-choco-lab/rag/pkg/content"
+)
+
+const (
+	walFileSuffix  = ".wal"
+	walOpAdd       = "add"
+	walOpDelete    = "delete"
+	walOpMetadata  = "metadata"
+	minCompactSize = 1 << 20
+)
+
+// walEntry replays idempotently: an add replaces every record of the document
+// and a metadata update overwrites it.
+type walEntry struct {
+	Op      string   `json:"op"`
+	DocID   string   `json:"doc_id"`
+	Records []record `json:"records,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (s *jsonCollection) walPath() string {
+	return s.path + walFileSuffix
+}
+
+func (s *jsonCollection) apply(e walEntry) {
+	if e.Op == walOpMetadata {
+		for i := range s.records {
+			if s.records[i].DocID == e.DocID {
+				s.records[i].Metadata = e.Metadata
+			}
+		}
+		return
+	}
+
+	s.records = s.deleteRecords(e.DocID)
+	if e.Op == walOpAdd {
+		s.prepare(e.Records, true)
+		s.records = append(s.records, e.Records...)
+	}
+}
+
+// replayWAL skips a torn final record, which the next append overwrites, and
+// fails on a complete record that does not decode.
+func (s *jsonCollection) replayWAL() error {
+	f, err := os.Open(s.walPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(s.walOffset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		e, n, err := s.codec.decodeEntry(data)
+		if err != nil {
+			return fmt.Errorf("corrupt log record at offset %d of %s: %w", s.walOffset, s.walPath(), err)
+		}
+		if n == 0 {
+			return nil
+		}
+		s.apply(e)
+		s.walOffset += int64(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+func (s *jsonCollection) appendWAL(entries []walEntry) error {
+	var buf []byte
+	for _, e := range entries {
+		entry, err := s.codec.encodeEntry(e)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, entry...)
+	}
+
+	f, err := os.OpenFile(s.walPath(), os.O_CREATE|os.O_WRONLY, defaultFilePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(s.walOffset); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(buf, s.walOffset); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	s.walOffset += int64(len(buf))
+
+	s.stamp, err = s.currentStamp()
+	return err
+}
+
+func (s *jsonCollection) Compact(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.reloadIfChanged(); err != nil {
+		return err
+	}
+	return s.compact()
+}
+
+// compact is safe to interrupt: replaying the old log onto the new snapshot
+// is a no-op.
+func (s *jsonCollection) compact() error {
+	if err := s.save(); err != nil {
+		s.stamp = storeStamp{}
+		return err
+	}
+	if err := os.Truncate(s.walPath(), 0); err != nil && !os.IsNotExist(err) {
+		s.stamp = storeStamp{}
+		return err
+	}
+	s.walOffset = 0
+	if s.quantization.Mode != content.QuantizeNone {
+		if err := s.load(); err != nil {
+			s.stamp = storeStamp{}
+			return err
+		}
+	}
+
+	var err error
+	s.stamp, err = s.currentStamp()
+	return err
+}
+
+func (s *jsonCollection) drop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := s.lock.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, path := range []string{s.path, s.walPath()} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.records = nil
+	s.walOffset = 0
+	s.stamp = storeStamp{}
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	if s.history != nil {
+		return s.history.drop()
+	}
+	return nil
+}
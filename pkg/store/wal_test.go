@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReplayWAL(t *testing.T) {
+	for name, codec := range map[string]snapshotCodec{
+		"json":   jsonCodec{},
+		"binary": binaryCodec{vectorType: VectorFloat32},
+	} {
+		// corrupt is the offset into an entry of a byte that cannot change
+		// without failing its decoding.
+		corrupt := 1
+		if name == "binary" {
+			corrupt = binaryEntryHeaderSize + 2
+		}
+
+		t.Run(name+"/torn final entry", func(t *testing.T) {
+			path, ends := writeTestWAL(t, codec, "a", "b", "c")
+			if err := os.Truncate(path+walFileSuffix, int64(ends[2]-3)); err != nil {
+				t.Fatal(err)
+			}
+			s := newJSONStore(path, codec, JSONOptions{})
+			checkDocIDs(t, s, "a", "b")
+
+			if _, err := s.AddDocument(context.Background(), "", "d", "text d", nil, AddOptions{ChunkSize: 100}, testEmbeddings); err != nil {
+				t.Fatal(err)
+			}
+			checkDocIDs(t, newJSONStore(path, codec, JSONOptions{}), "a", "b", "d")
+		})
+
+		t.Run(name+"/corrupt middle entry", func(t *testing.T) {
+			path, ends := writeTestWAL(t, codec, "a", "b", "c")
+			data, err := os.ReadFile(path + walFileSuffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[ends[0]+corrupt] ^= 0xff
+			if err := os.WriteFile(path+walFileSuffix, data, defaultFilePerm); err != nil {
+				t.Fatal(err)
+			}
+			s := newJSONStore(path, codec, JSONOptions{})
+			if docs, err := s.ListDocuments(context.Background(), "", ListOptions{}); err == nil {
+				t.Errorf("replaying a corrupt entry succeeded with %+v", docs)
+			}
+		})
+
+		t.Run(name+"/zeroed tail", func(t *testing.T) {
+			path, _ := writeTestWAL(t, codec, "a", "b")
+			f, err := os.OpenFile(path+walFileSuffix, os.O_WRONLY|os.O_APPEND, defaultFilePerm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Write(make([]byte, 16))
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkDocIDs(t, newJSONStore(path, codec, JSONOptions{}), "a", "b")
+		})
+	}
+}
+
+// writeTestWAL adds one document per ID to a fresh store and returns its path
+// and the offsets at which each entry of the log ends.
+func writeTestWAL(t *testing.T, codec snapshotCodec, docIDs ...string) (string, []int) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := newJSONStore(path, codec, JSONOptions{})
+	var ends []int
+	for _, id := range docIDs {
+		if _, err := s.AddDocument(context.Background(), "", id, "text "+id, nil, AddOptions{ChunkSize: 100}, testEmbeddings); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path + walFileSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, int(info.Size()))
+	}
+	return path, ends
+}
+
+func checkDocIDs(t *testing.T, s Store, want ...string) {
+	t.Helper()
+	docs, err := s.ListDocuments(context.Background(), "", ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range docs {
+		got = append(got, d.DocID)
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("documents %v, want %v", got, want)
+	}
+}